@@ -0,0 +1,493 @@
+package pkg
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// DefaultMicromambaVersion is the micromamba release downloaded when no version is requested.
+// Pinning the release keeps every machine on the same micromamba build.
+const DefaultMicromambaVersion = "1.5.7-0"
+
+// ErrChecksumMismatch is returned when a downloaded file does not match its expected hash
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrUnknownMicromambaChecksum is returned when micromamba would be installed without a hash to
+// verify it against, because neither CreateOptions.MicromambaSHA256 nor kinda's table of known
+// releases has one
+var ErrUnknownMicromambaChecksum = errors.New("no known checksum for micromamba")
+
+// micromambaChecksums holds the SHA-256 of the micromamba executable by release and platform.  It is
+// compiled into kinda so an executable is never checked against a hash served from the same place
+// as the executable itself.  The hashes are the contents of the micromamba-<platform>.sha256 files
+// published with the release; add the new release here when changing DefaultMicromambaVersion.
+var micromambaChecksums = map[string]map[string]string{
+	DefaultMicromambaVersion: {
+		// "linux-64":     contents of micromamba-linux-64.sha256,
+		// "linux-arm64":  contents of micromamba-linux-arm64.sha256,
+		// "osx-64":       contents of micromamba-osx-64.sha256,
+		// "osx-arm64":    contents of micromamba-osx-arm64.sha256,
+		// "win-64":       contents of micromamba-win-64.sha256,
+	},
+}
+
+// micromambaSHA256 returns the hash the micromamba executable for platform must have:
+// opts.MicromambaSHA256 if given, otherwise the hash of the pinned release in micromambaChecksums
+func micromambaSHA256(opts *CreateOptions, platform string) (string, error) {
+	if opts.MicromambaSHA256 != "" {
+		return strings.ToLower(opts.MicromambaSHA256), nil
+	}
+	version := opts.micromambaVersion()
+	if sha := micromambaChecksums[version][platform]; sha != "" {
+		return sha, nil
+	}
+	return "", fmt.Errorf("%w %s on %s, set MicromambaSHA256 to install it", ErrUnknownMicromambaChecksum, version, platform)
+}
+
+// micromambaPlatform returns micromamba's name for the current platform, e.g. "linux-64" or "osx-arm64"
+func micromambaPlatform() (string, error) {
+	return micromambaPlatformFor(runtime.GOOS, runtime.GOARCH)
+}
+
+// micromambaPlatformFor returns micromamba's name for the Go platform goos/goarch
+func micromambaPlatformFor(goos string, goarch string) (string, error) {
+	platform := goos
+	arch := goarch
+
+	// Convert platform and arch to match micromamba naming
+	if platform == "darwin" {
+		platform = "osx"
+	} else if platform == "windows" {
+		platform = "win"
+	}
+
+	switch arch {
+	case "amd64":
+		arch = "64"
+	case "arm64":
+		if platform == "win" {
+			// As of now, there is not a separate arm64 download for Windows
+			arch = "64"
+		}
+	default:
+		return "", fmt.Errorf("unsupported architecture: %s", arch)
+	}
+	return platform + "-" + arch, nil
+}
+
+// micromambaExecutable returns the path of the micromamba executable in binFolder
+func micromambaExecutable(binFolder string) string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(binFolder, "micromamba.exe")
+	}
+	return filepath.Join(binFolder, "micromamba")
+}
+
+// ensureMicromamba makes sure binFolder holds a working micromamba and returns its version output.
+// micromamba is downloaded when it is missing, or when opts pins a different version.
+func ensureMicromamba(ctx context.Context, binFolder string, opts *CreateOptions, reporter Reporter) (string, error) {
+	binpath := micromambaExecutable(binFolder)
+
+	// Check if binFolder already has micromamba by getting it's version
+	mver, err := RunReadStdoutContext(ctx, binpath, "--version")
+	if err != nil {
+		if _, ok := err.(*fs.PathError); !ok {
+			return "", fmt.Errorf("error running micromamba --version: %v", err)
+		}
+	} else if opts.MicromambaVersion == "" || sameMicromambaVersion(mver, opts.MicromambaVersion) {
+		return mver, nil
+	}
+
+	// download micromamba if it doesn't exist or isn't the pinned version
+	if _, err := expectMicromamba(ctx, binFolder, opts, reporter); err != nil {
+		return "", fmt.Errorf("error downloading micromamba: %w", err)
+	}
+	mver, err = RunReadStdoutContext(ctx, binpath, "--version")
+	if err != nil {
+		return "", fmt.Errorf("error running micromamba --version: %v", err)
+	}
+	// a local or embedded source may hold another release than the one pinned
+	if opts.MicromambaVersion != "" && !sameMicromambaVersion(mver, opts.MicromambaVersion) {
+		return "", fmt.Errorf("installed micromamba is version %s, not the pinned %s", strings.TrimSpace(mver), opts.MicromambaVersion)
+	}
+	return mver, nil
+}
+
+// sameMicromambaVersion reports whether the output of micromamba --version matches a release
+// name such as "1.5.7-0"
+func sameMicromambaVersion(versionOutput string, release string) bool {
+	have, err := ParseVersion(strings.TrimSpace(versionOutput))
+	if err != nil {
+		return false
+	}
+	want, err := ParseVersion(release)
+	if err != nil {
+		return false
+	}
+	return have.Compare(want) == 0
+}
+
+// ExpectMicromamba downloads the pinned micromamba release for the current platform into
+// binFolder and returns its path.
+func ExpectMicromamba(binFolder string, feedback CreateEnvironmentOptions) (string, error) {
+	return ExpectMicromambaContext(context.Background(), binFolder, feedback)
+}
+
+// ExpectMicromambaContext is like ExpectMicromamba but aborts the download when ctx is done.
+func ExpectMicromambaContext(ctx context.Context, binFolder string, feedback CreateEnvironmentOptions) (string, error) {
+	return expectMicromamba(ctx, binFolder, &CreateOptions{}, FeedbackReporter(feedback))
+}
+
+// MicromambaSource tells kinda where to get the micromamba executable from.  At most one
+// of BaseURL, Path and FS should be set; the zero value downloads from the micromamba
+// GitHub releases.
+type MicromambaSource struct {
+	// Base URL of a mirror laid out like the GitHub releases, i.e. serving
+	// <BaseURL>/<version>/micromamba-<platform>
+	BaseURL string
+	// Path of a local micromamba executable to copy into the root
+	Path string
+	// File system holding a micromamba executable at FSPath, e.g. an embed.FS compiled into your program
+	FS     fs.FS
+	FSPath string
+}
+
+// DefaultMicromambaBaseURL is where micromamba releases are downloaded from by default
+const DefaultMicromambaBaseURL = "https://github.com/mamba-org/micromamba-releases/releases/download"
+
+// expectMicromamba installs the micromamba release pinned by opts into binFolder from opts.MicromambaSource.
+// The executable, downloaded or copied, is only made executable once its SHA-256 matches
+// opts.MicromambaSHA256, or the hash of the release in micromambaChecksums when no checksum is given.
+func expectMicromamba(ctx context.Context, binFolder string, opts *CreateOptions, reporter Reporter) (string, error) {
+	platform, err := micromambaPlatform()
+	if err != nil {
+		return "", err
+	}
+
+	// Ensure the target bin directory exists
+	if err := os.MkdirAll(binFolder, 0755); err != nil {
+		return "", fmt.Errorf("error creating directory: %v", err)
+	}
+
+	// Target binary path
+	binpath := micromambaExecutable(binFolder)
+	source := opts.MicromambaSource
+
+	expectedSHA256, err := micromambaSHA256(opts, platform)
+	if err != nil {
+		return "", err
+	}
+
+	// local copies are checked against the same checksum as downloads
+	if source.Path != "" || source.FS != nil {
+		var src io.ReadCloser
+		if source.Path != "" {
+			src, err = os.Open(source.Path)
+		} else {
+			src, err = source.FS.Open(source.FSPath)
+		}
+		if err != nil {
+			return "", fmt.Errorf("error opening micromamba source: %v", err)
+		}
+		defer src.Close()
+		if err := installFile(src, binpath, 0755, expectedSHA256); err != nil {
+			return "", fmt.Errorf("error installing micromamba: %w", err)
+		}
+		return binpath, nil
+	}
+
+	client, err := opts.httpClient()
+	if err != nil {
+		return "", err
+	}
+
+	// Construct the download URL
+	// https://github.com/mamba-org/micromamba-releases/releases/download/1.5.7-0/micromamba-osx-arm64
+	baseURL := strings.TrimSuffix(source.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = DefaultMicromambaBaseURL
+	}
+	version := opts.micromambaVersion()
+	downloadURL := fmt.Sprintf("%s/%s/micromamba-%s", baseURL, version, platform)
+
+	// Download the binary next to its final location and only move it into place once it is
+	// complete and verified, so an interrupted download never leaves a corrupt micromamba behind
+	err = downloadFile(ctx, &downloadSpec{
+		client:   client,
+		url:      downloadURL,
+		dest:     binpath,
+		sha256:   expectedSHA256,
+		mode:     0755,
+		retries:  opts.downloadRetries(),
+		step:     "download micromamba",
+		reporter: reporter,
+	})
+	if err != nil {
+		return "", err
+	}
+	return binpath, nil
+}
+
+// installFile copies r to dest through a temporary file, verifying the copy against expectedSHA256
+// before moving it into place
+func installFile(r io.Reader, dest string, mode os.FileMode, expectedSHA256 string) error {
+	tmpPath := dest + ".part"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = verifySHA256(tmpPath, expectedSHA256, dest)
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, mode)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, dest)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// downloadSpec describes a file for downloadFile to fetch
+type downloadSpec struct {
+	client   *http.Client
+	url      string
+	dest     string      // Final path of the file
+	sha256   string      // Expected SHA-256 as hex, empty to skip verification
+	md5      string      // Expected MD5 as hex, empty to skip verification
+	mode     os.FileMode // Permissions of the final file
+	retries  int         // Number of times a failed attempt is retried
+	step     string
+	reporter Reporter
+}
+
+// httpStatusError is returned for a response that isn't the expected 200 or 206
+type httpStatusError struct {
+	url    string
+	status string
+	code   int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %s from %s", e.status, e.url)
+}
+
+// retryable reports whether an attempt failing with err may succeed when tried again
+func retryable(err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code == http.StatusTooManyRequests || statusErr.code >= 500
+	}
+	return !errors.Is(err, ErrChecksumMismatch)
+}
+
+// downloadFile downloads d.url to d.dest.  The body is written to d.dest+".part", resuming
+// with a Range request when a previous attempt was interrupted, and failed attempts are
+// retried with exponential backoff.  The partial file is renamed to d.dest only once it is
+// complete and matches d.sha256.
+func downloadFile(ctx context.Context, d *downloadSpec) error {
+	partPath := d.dest + ".part"
+	_, statErr := os.Stat(partPath)
+	resumed := statErr == nil
+
+	err := downloadWithRetries(ctx, d, partPath)
+	if err == nil {
+		err = d.verify(partPath)
+		if err != nil && resumed {
+			// the partial file may have been left by a download of something else, start from scratch
+			os.Remove(partPath)
+			err = downloadWithRetries(ctx, d, partPath)
+			if err == nil {
+				err = d.verify(partPath)
+			}
+		}
+	}
+	if err == nil {
+		err = os.Chmod(partPath, d.mode)
+	}
+	if err == nil {
+		err = os.Rename(partPath, d.dest)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("download cancelled: %v", ctx.Err())
+		} else if !retryable(err) {
+			// keep interrupted downloads for resuming later, but not broken ones
+			os.Remove(partPath)
+		}
+		err = fmt.Errorf("error downloading %s: %w", d.url, err)
+		d.reporter.Report(Event{Kind: EventError, Step: d.step, Err: err})
+		return err
+	}
+	d.reporter.Report(Event{Kind: EventDownloadFinished, Step: d.step})
+	return nil
+}
+
+// downloadWithRetries completes partPath, retrying failed attempts with exponential backoff
+func downloadWithRetries(ctx context.Context, d *downloadSpec, partPath string) error {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := downloadAttempt(ctx, d, partPath)
+		if err == nil || ctx.Err() != nil || !retryable(err) || attempt >= d.retries {
+			return err
+		}
+
+		// wait before trying again, giving up if ctx is done
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// downloadAttempt makes a single attempt at completing partPath, resuming from its current size
+func downloadAttempt(ctx context.Context, d *downloadSpec, partPath string) error {
+	var offset int64
+	if fi, err := os.Stat(partPath); err == nil {
+		offset = fi.Size()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", d.url, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// the server sent the whole file, start over
+		offset = 0
+		flags |= os.O_TRUNC
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			os.Remove(partPath)
+			return fmt.Errorf("invalid Content-Range %q for offset %d", resp.Header.Get("Content-Range"), offset)
+		}
+		flags |= os.O_APPEND
+	case http.StatusRequestedRangeNotSatisfiable:
+		if offset == 0 {
+			return &httpStatusError{url: d.url, status: resp.Status, code: resp.StatusCode}
+		}
+		// the partial file doesn't fit the file on the server, start over from the beginning
+		resp.Body.Close()
+		if err := os.Truncate(partPath, 0); err != nil {
+			return fmt.Errorf("error truncating file: %v", err)
+		}
+		return downloadAttempt(ctx, d, partPath)
+	default:
+		return &httpStatusError{url: d.url, status: resp.Status, code: resp.StatusCode}
+	}
+
+	outFile, err := os.OpenFile(partPath, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating file: %v", err)
+	}
+	defer outFile.Close()
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	d.reporter.Report(Event{Kind: EventDownloadStarted, Step: d.step, Message: fmt.Sprintf("Downloading %s to %s", d.url, d.dest), Package: filepath.Base(d.dest), Bytes: offset, Total: total})
+	written, err := io.Copy(outFile, &progressReader{r: resp.Body, n: offset, total: total, step: d.step, reporter: d.reporter})
+	if err == nil {
+		err = outFile.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("error writing file: %v", err)
+	}
+	if resp.ContentLength >= 0 && written != resp.ContentLength {
+		return fmt.Errorf("short download, got %d of %d bytes: %v", written, resp.ContentLength, io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+// verify checks the file at path against the expected hashes of d
+func (d *downloadSpec) verify(path string) error {
+	if err := verifySHA256(path, d.sha256, d.url); err != nil {
+		return err
+	}
+	return verifyMD5(path, d.md5, d.url)
+}
+
+// verifySHA256 checks the SHA-256 of the file at path against expected, which may be empty
+func verifySHA256(path string, expected string, url string) error {
+	return verifyDigest(path, sha256.New(), "sha256", expected, url)
+}
+
+// verifyMD5 checks the MD5 of the file at path against expected, which may be empty
+func verifyMD5(path string, expected string, url string) error {
+	return verifyDigest(path, md5.New(), "md5", expected, url)
+}
+
+// verifyDigest checks the digest of the file at path computed by hash against expected
+func verifyDigest(path string, hash hash.Hash, name string, expected string, url string) error {
+	if expected == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != strings.ToLower(expected) {
+		return fmt.Errorf("%w for %s: expected %s %s, got %s", ErrChecksumMismatch, url, name, expected, actual)
+	}
+	return nil
+}
+
+// progressReader reports download progress for the bytes read through it
+type progressReader struct {
+	r        io.Reader
+	n        int64
+	total    int64
+	step     string
+	reporter Reporter
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.n += int64(n)
+		p.reporter.Report(Event{Kind: EventDownloadProgress, Step: p.step, Bytes: p.n, Total: p.total})
+	}
+	return n, err
+}
@@ -0,0 +1,175 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer serves content at /file and records the Range header of every request
+type testServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	ranges []string
+}
+
+func newTestServer(t *testing.T, content []byte) *testServer {
+	ts := &testServer{}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts.mu.Lock()
+		ts.ranges = append(ts.ranges, r.Header.Get("Range"))
+		ts.mu.Unlock()
+		if r.URL.Path != "/file" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func testDownloadSpec(ts *testServer, dest string, content []byte) *downloadSpec {
+	sum := sha256.Sum256(content)
+	return &downloadSpec{
+		client:   ts.Client(),
+		url:      ts.URL + "/file",
+		dest:     dest,
+		sha256:   hex.EncodeToString(sum[:]),
+		mode:     0644,
+		step:     "test",
+		reporter: nopReporter{},
+	}
+}
+
+func TestDownloadFile(t *testing.T) {
+	content := bytes.Repeat([]byte("micromamba"), 1000)
+	half := len(content) / 2
+	tests := []struct {
+		name      string
+		part      []byte // contents of dest.part before the download, nil for none
+		wantRange string // Range header of the first request
+	}{
+		{name: "fresh", wantRange: ""},
+		{name: "resume", part: content[:half], wantRange: "bytes=5000-"},
+		// a partial file of something else fails verification and is downloaded again from scratch
+		{name: "stale partial file", part: bytes.Repeat([]byte("x"), half), wantRange: "bytes=5000-"},
+		// a partial file longer than the file gets 416 and is truncated
+		{name: "range not satisfiable", part: append(append([]byte(nil), content...), "extra"...), wantRange: "bytes=10005-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, content)
+			dest := filepath.Join(t.TempDir(), "micromamba")
+			if tt.part != nil {
+				if err := os.WriteFile(dest+".part", tt.part, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := downloadFile(context.Background(), testDownloadSpec(ts, dest, content)); err != nil {
+				t.Fatalf("downloadFile: %v", err)
+			}
+			got, err := os.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("downloaded %d bytes, want the %d bytes served", len(got), len(content))
+			}
+			if _, err := os.Stat(dest + ".part"); !os.IsNotExist(err) {
+				t.Errorf("partial file left behind: %v", err)
+			}
+			if ts.ranges[0] != tt.wantRange {
+				t.Errorf("first request has Range %q, want %q", ts.ranges[0], tt.wantRange)
+			}
+		})
+	}
+}
+
+func TestDownloadFileNotFound(t *testing.T) {
+	content := []byte("micromamba")
+	ts := newTestServer(t, content)
+	dest := filepath.Join(t.TempDir(), "micromamba")
+	d := testDownloadSpec(ts, dest, content)
+	d.url = ts.URL + "/missing"
+	d.retries = 3
+
+	err := downloadFile(context.Background(), d)
+	var statusErr *httpStatusError
+	if !errors.As(err, &statusErr) || statusErr.code != http.StatusNotFound {
+		t.Fatalf("downloadFile returned %v, want a 404 status error", err)
+	}
+	if len(ts.ranges) != 1 {
+		t.Errorf("made %d requests, a 404 must not be retried", len(ts.ranges))
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("destination exists after a failed download: %v", err)
+	}
+}
+
+func TestDownloadFileChecksumMismatch(t *testing.T) {
+	content := []byte("micromamba")
+	ts := newTestServer(t, content)
+	dest := filepath.Join(t.TempDir(), "micromamba")
+	d := testDownloadSpec(ts, dest, []byte("something else"))
+
+	err := downloadFile(context.Background(), d)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("downloadFile returned %v, want ErrChecksumMismatch", err)
+	}
+	for _, path := range []string{dest, dest + ".part"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s exists after a checksum mismatch: %v", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestExpectMicromambaVerifiesLocalSource(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source")
+	if err := os.WriteFile(source, []byte("micromamba"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	binFolder := filepath.Join(dir, "bin")
+
+	opts := &CreateOptions{MicromambaSource: MicromambaSource{Path: source}, MicromambaSHA256: hex.EncodeToString(make([]byte, sha256.Size))}
+	if _, err := expectMicromamba(context.Background(), binFolder, opts, nopReporter{}); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expectMicromamba returned %v, want ErrChecksumMismatch", err)
+	}
+
+	opts = &CreateOptions{MicromambaSource: MicromambaSource{Path: source}, MicromambaVersion: "0.0.1-0"}
+	if _, err := expectMicromamba(context.Background(), binFolder, opts, nopReporter{}); !errors.Is(err, ErrUnknownMicromambaChecksum) {
+		t.Errorf("expectMicromamba returned %v, want ErrUnknownMicromambaChecksum", err)
+	}
+	if _, err := os.Stat(micromambaExecutable(binFolder)); !os.IsNotExist(err) {
+		t.Errorf("unverified micromamba was installed: %v", err)
+	}
+}
+
+func TestDefaultMicromambaChecksums(t *testing.T) {
+	// every Go platform micromambaPlatformFor maps to a micromamba release
+	for _, goos := range []string{"linux", "darwin", "windows"} {
+		for _, goarch := range []string{"amd64", "arm64"} {
+			platform, err := micromambaPlatformFor(goos, goarch)
+			if err != nil {
+				t.Fatalf("micromambaPlatformFor(%s, %s): %v", goos, goarch, err)
+			}
+			sha, err := micromambaSHA256(&CreateOptions{}, platform)
+			if err != nil {
+				t.Errorf("no checksum for micromamba %s on %s: %v", DefaultMicromambaVersion, platform, err)
+			} else if !sha256Regexp.MatchString(sha) {
+				t.Errorf("checksum %q for micromamba %s on %s is not a hex SHA-256", sha, DefaultMicromambaVersion, platform)
+			}
+		}
+	}
+}
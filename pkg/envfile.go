@@ -0,0 +1,237 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvironmentFile is a conda environment.yml
+type EnvironmentFile struct {
+	Name         string   // Name of the environment, may be empty
+	Channels     []string // Channels to install from, in priority order
+	Dependencies []string // Conda specs
+	Pip          []string // Requirements from the nested pip: section
+}
+
+// environmentFileYAML mirrors the layout of environment.yml, where dependencies mixes conda specs
+// with a {pip: [...]} mapping
+type environmentFileYAML struct {
+	Name         string      `yaml:"name"`
+	Channels     []string    `yaml:"channels"`
+	Dependencies []yaml.Node `yaml:"dependencies"`
+}
+
+// pythonSpecRegexp matches a python conda spec, capturing the version constraint
+var pythonSpecRegexp = regexp.MustCompile(`^python\s*(?:[=<>!~ ].*)?$`)
+
+// buildStringRegexp matches the build string after the version of a conda spec, e.g. "=h955ad1f_0"
+// in "=3.11.4=h955ad1f_0" or " *_cpython" in "3.11.* *_cpython"
+var buildStringRegexp = regexp.MustCompile(`[\d*](?:=| +)\S*$`)
+
+// ParseEnvironmentFile parses the contents of an environment.yml
+func ParseEnvironmentFile(data []byte) (*EnvironmentFile, error) {
+	var raw environmentFileYAML
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("error parsing environment file: %v", err)
+	}
+
+	ef := &EnvironmentFile{Name: raw.Name, Channels: raw.Channels}
+	for _, node := range raw.Dependencies {
+		switch node.Kind {
+		case yaml.ScalarNode:
+			ef.Dependencies = append(ef.Dependencies, strings.TrimSpace(node.Value))
+		case yaml.MappingNode:
+			var section map[string][]string
+			if err := node.Decode(&section); err != nil {
+				return nil, fmt.Errorf("error parsing environment file line %d: %v", node.Line, err)
+			}
+			for key, requirements := range section {
+				if key != "pip" {
+					return nil, fmt.Errorf("unsupported dependency section %q in environment file line %d", key, node.Line)
+				}
+				ef.Pip = append(ef.Pip, requirements...)
+			}
+		default:
+			return nil, fmt.Errorf("unexpected dependency in environment file line %d", node.Line)
+		}
+	}
+	return ef, nil
+}
+
+// ReadEnvironmentFile reads and parses an environment.yml
+func ReadEnvironmentFile(path string) (*EnvironmentFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading environment file: %v", err)
+	}
+	return ParseEnvironmentFile(data)
+}
+
+// Marshal returns the environment.yml form of the file
+func (ef *EnvironmentFile) Marshal() ([]byte, error) {
+	out := struct {
+		Name         string        `yaml:"name,omitempty"`
+		Channels     []string      `yaml:"channels"`
+		Dependencies []interface{} `yaml:"dependencies"`
+	}{Name: ef.Name, Channels: ef.Channels}
+	for _, dep := range ef.Dependencies {
+		out.Dependencies = append(out.Dependencies, dep)
+	}
+	if len(ef.Pip) > 0 {
+		out.Dependencies = append(out.Dependencies, map[string][]string{"pip": ef.Pip})
+	}
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(&out); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), enc.Close()
+}
+
+// WriteFile writes the environment.yml form of the file to path
+func (ef *EnvironmentFile) WriteFile(path string) error {
+	data, err := ef.Marshal()
+	if err != nil {
+		return fmt.Errorf("error encoding environment file: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("error writing environment file: %v", err)
+	}
+	return nil
+}
+
+// pythonConstraint returns the constraint of the file's python dependency without the build string,
+// e.g. ">=3.11,<3.13" for "python>=3.11,<3.13", or "" if it doesn't pin one
+func (ef *EnvironmentFile) pythonConstraint() string {
+	for _, dep := range ef.Dependencies {
+		if !pythonSpecRegexp.MatchString(dep) {
+			continue
+		}
+		constraint := strings.TrimSpace(strings.TrimPrefix(dep, "python"))
+		if loc := buildStringRegexp.FindStringIndex(constraint); loc != nil {
+			constraint = constraint[:loc[0]+1]
+		}
+		return constraint
+	}
+	return ""
+}
+
+// SectionResult is the outcome of installing one section of an environment.yml
+type SectionResult struct {
+	Packages []string // Specs in the section
+	Skipped  bool     // The section was not installed, because it was empty or an earlier section failed
+	Err      error    // Why installing the section failed
+}
+
+// EnvironmentFileResult reports the outcome of each section of an environment.yml
+type EnvironmentFileResult struct {
+	Conda SectionResult // The conda dependencies, installed by micromamba
+	Pip   SectionResult // The nested pip: section, installed by pip
+}
+
+// CreateEnvironmentFromFile creates an environment from an environment.yml.  The conda dependencies
+// are solved by micromamba in a single create, then the pip section is installed with pip.  envName
+// defaults to the file's name; the file's channels take priority over opts.Channels.  An existing
+// environment is reused without installing the conda dependencies again.
+//
+// The result reports each section separately, also when an error is returned.  With opts.DryRun only
+// the conda dependencies are solved and the pip section is skipped.
+func CreateEnvironmentFromFile(ctx context.Context, envName string, rootDir string, path string, opts *CreateOptions) (*Environment, *EnvironmentFileResult, error) {
+	ef, err := ReadEnvironmentFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if envName == "" {
+		envName = ef.Name
+	}
+	if envName == "" {
+		return nil, nil, fmt.Errorf("no environment name given and none in %s", path)
+	}
+
+	// don't modify the caller's options
+	fileOpts := CreateOptions{}
+	if opts != nil {
+		fileOpts = *opts
+	}
+	fileOpts.Channels = appendUnique(append([]string(nil), ef.Channels...), fileOpts.Channels...)
+	specs := append(append([]string(nil), ef.Dependencies...), fileOpts.Packages...)
+	if constraint := ef.pythonConstraint(); constraint != "" {
+		fileOpts.PythonVersion = constraint
+	}
+
+	result := &EnvironmentFileResult{
+		Conda: SectionResult{Packages: specs},
+		Pip:   SectionResult{Packages: ef.Pip, Skipped: len(ef.Pip) == 0},
+	}
+
+	env, created, err := createEnvironment(ctx, envName, rootDir, &fileOpts, environmentSpec{packages: specs})
+	if err != nil {
+		result.Conda.Err = err
+		result.Pip.Skipped = true
+		return nil, result, err
+	}
+	result.Conda.Skipped = !created && !fileOpts.DryRun
+	if fileOpts.DryRun {
+		// pip can't resolve against an environment that doesn't exist yet
+		result.Pip.Skipped = true
+		return env, result, nil
+	}
+
+	if len(ef.Pip) > 0 {
+		if err := installPipSection(ctx, env, path, ef.Pip, fileOpts.Feedback); err != nil {
+			result.Pip.Err = err
+			return env, result, err
+		}
+	}
+	return env, result, nil
+}
+
+// installPipSection installs the pip: section of the environment.yml at path the way conda does,
+// from a temporary requirements file next to it.  Options such as "--index-url ..." and "-r other.txt"
+// work as in any requirements file, and "-r" and "-c" paths are relative to the environment.yml.
+func installPipSection(ctx context.Context, env *Environment, path string, requirements []string, feedback CreateEnvironmentOptions) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, ".kinda-pip-*.txt")
+	if err != nil {
+		return fmt.Errorf("error writing pip requirements: %v", err)
+	}
+	defer os.Remove(f.Name())
+	for _, line := range requirements {
+		fmt.Fprintln(f, absoluteRequirementPath(dir, line))
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing pip requirements: %v", err)
+	}
+	return env.PipInstallRequirementsWithOptions(ctx, f.Name(), &PipInstallOptions{Feedback: feedback})
+}
+
+// absoluteRequirementPath makes the relative local path of a requirement line, e.g. "-e ." or
+// "./vendor/pkg", absolute against dir.  pip resolves those against its working directory, not
+// against the requirements file.
+func absoluteRequirementPath(dir string, line string) string {
+	prefix, target := "", strings.TrimSpace(line)
+	for _, option := range []string{"-e ", "--editable ", "--editable="} {
+		if strings.HasPrefix(target, option) {
+			prefix, target = option, strings.TrimSpace(target[len(option):])
+			break
+		}
+	}
+	// extras stay behind the path, e.g. ".[dev]"
+	extras := ""
+	if i := strings.Index(target, "["); i >= 0 {
+		target, extras = target[:i], target[i:]
+	}
+	if target == "." || target == ".." || strings.HasPrefix(target, "./") || strings.HasPrefix(target, "../") ||
+		strings.HasPrefix(target, ".\\") || strings.HasPrefix(target, "..\\") {
+		return prefix + filepath.Join(dir, target) + extras
+	}
+	return line
+}
@@ -1,34 +1,39 @@
 package pkg
 
 import (
-	"bufio"
+	"context"
 	"fmt"
-	"io"
-	"io/fs"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
-
-	"github.com/schollz/progressbar/v3"
+	"time"
 )
 
 type Environment struct {
-	Name              string  // Name of the environment
-	RootDir           string  // Root directory of the environment
-	EnvPath           string  // Path to the environment
-	EnvBinPath        string  // Path to the bin directory within the environment
-	EnvLibPath        string  // Path to the lib directory within the environment
-	PythonVersion     Version // Version of the Python environment
-	MicromambaVersion Version // Version of the micromamba executable
-	PipVersion        Version // Version of the pip executable
-	MicromambaPath    string  // Path to the micromamba executable
-	PythonPath        string  // Path to the Python executable within the environment
-	PythonLibPath     string  // Path to the Python library within the environment
-	PipPath           string  // Path to the pip executable within the environment
-	PythonHeadersPath string  // Path to the Python headers within the environment
-	SitePackagesPath  string  // Path to the site-packages directory within the environment
+	Name                 string          // Name of the environment
+	RootDir              string          // Root directory of the environment
+	EnvPath              string          // Path to the environment
+	EnvBinPath           string          // Path to the bin directory within the environment
+	EnvLibPath           string          // Path to the lib directory within the environment
+	PythonVersion        Version         // Version of the Python environment
+	MicromambaVersion    Version         // Version of the micromamba executable
+	PipVersion           Version         // Version of the pip executable
+	MicromambaPath       string          // Path to the micromamba executable
+	PythonPath           string          // Path to the Python executable within the environment
+	PythonLibPath        string          // Path to the Python library within the environment
+	PipPath              string          // Path to the pip executable within the environment
+	PythonHeadersPath    string          // Path to the Python headers within the environment
+	SitePackagesPath     string          // Path to the site-packages directory within the environment
+	PlatSitePackagesPath string          // Path to the site-packages directory for platform specific packages
+	Interpreter          InterpreterInfo // What the environment's interpreter reports through sysconfig
+	Manifest             *Manifest       // How the environment was created, nil if it has no manifest
+	Transaction          *Transaction    // What micromamba did to create the environment, nil if it already existed
+	Reporter             Reporter        // Receives progress events, overrides the feedback passed to install methods when set
+	HTTPClient           *http.Client    // Client for downloads, built from ProxyURL and CABundle when nil
+	ProxyURL             string          // Proxy used by downloads, micromamba and pip
+	CABundle             string          // Additional CA certificates trusted by downloads, micromamba and pip
+	LockTimeout          time.Duration   // How long to wait for other processes changing the environment, 0 for DefaultLockTimeout
 }
 
 // user feedback options for CreateEnvironment
@@ -45,14 +50,156 @@ const (
 	ShowNothing
 )
 
+// CreateOptions holds everything environment creation can be configured with.
+// The zero value creates a Python 3.10 environment from micromamba's default
+// channels and shows a progress bar.
+type CreateOptions struct {
+	PythonVersion string                   // Requested Python version or constraint, e.g. "3.11" or ">=3.10,<3.12", defaults to "3.10"
+	Packages      []string                 // Additional conda specs, e.g. "numpy=1.26", solved together with python
+	Channels      []string                 // Channels to install from, in priority order
+	Feedback      CreateEnvironmentOptions // User feedback while creating
+	Reporter      Reporter                 // Receives progress events, overrides Feedback when set
+
+	// How the solver weighs Channels, defaults to micromamba's flexible priority
+	ChannelPriority ChannelPriority
+	// Use only Channels, ignoring the channels of micromamba's configuration
+	OverrideChannels bool
+	// Only solve, leaving the root untouched apart from micromamba itself and the root lock and CA
+	// bundle in <root>/.kinda.  Nothing is written for the environment.  The returned Environment
+	// has no paths within the environment; its Transaction holds what creation would do, or is nil
+	// if the environment already exists.
+	DryRun bool
+
+	// micromamba release to download, defaults to DefaultMicromambaVersion.  When set, an
+	// existing micromamba of a different version is replaced.
+	MicromambaVersion string
+	// Expected SHA-256 of the micromamba executable, defaults to kinda's compiled-in checksum of the release
+	MicromambaSHA256 string
+	// Where micromamba comes from, defaults to the micromamba GitHub releases
+	MicromambaSource MicromambaSource
+	// Client for every download kinda makes.  Defaults to a client using ProxyURL and
+	// CABundle, or http.DefaultClient when neither is set.
+	HTTPClient *http.Client
+	// Proxy for kinda's downloads and for micromamba and pip, e.g. "http://proxy:3128"
+	ProxyURL string
+	// Path of a PEM file with additional CA certificates trusted by kinda, micromamba and pip
+	CABundle string
+	// Number of times a failed download is retried, defaults to 3.  Use a negative value to disable retries.
+	DownloadRetries int
+	// How long to wait for other processes working on the same root or environment, defaults to DefaultLockTimeout
+	LockTimeout time.Duration
+}
+
+// ChannelPriority controls whether the solver may take a package from a lower priority channel
+type ChannelPriority int
+
+const (
+	// Prefer higher priority channels, but take newer versions from lower priority ones
+	ChannelPriorityFlexible ChannelPriority = iota
+	// Only take a package from the highest priority channel that has it
+	ChannelPriorityStrict
+	// Ignore channel order, only versions count
+	ChannelPriorityDisabled
+)
+
+// channelArgs returns the micromamba arguments selecting the channels
+func (opts *CreateOptions) channelArgs() []string {
+	return channelArgs(opts.Channels, opts.ChannelPriority, opts.OverrideChannels)
+}
+
+// reporter returns the Reporter for the creation, falling back to the built-in feedback
+func (opts *CreateOptions) reporter() Reporter {
+	if opts.Reporter != nil {
+		return opts.Reporter
+	}
+	return FeedbackReporter(opts.Feedback)
+}
+
+// pythonVersion returns the requested Python version or the default
+func (opts *CreateOptions) pythonVersion() string {
+	if opts.PythonVersion == "" {
+		return "3.10"
+	}
+	return opts.PythonVersion
+}
+
+// micromambaVersion returns the pinned micromamba release
+func (opts *CreateOptions) micromambaVersion() string {
+	if opts.MicromambaVersion == "" {
+		return DefaultMicromambaVersion
+	}
+	return opts.MicromambaVersion
+}
+
+// downloadRetries returns how often a failed download is retried
+func (opts *CreateOptions) downloadRetries() int {
+	if opts.DownloadRetries == 0 {
+		return 3
+	}
+	if opts.DownloadRetries < 0 {
+		return 0
+	}
+	return opts.DownloadRetries
+}
+
+// httpClient returns the client for downloads made during creation
+func (opts *CreateOptions) httpClient() (*http.Client, error) {
+	if opts.HTTPClient != nil {
+		return opts.HTTPClient, nil
+	}
+	return newHTTPClient(opts.ProxyURL, opts.CABundle)
+}
+
+// CreateEnvironment creates (or reuses) the named environment under rootDir, downloading
+// micromamba into rootDir/bin first if it is not already present.
 func CreateEnvironment(envName string, rootDir string, pythonVersion string, channel string, feedback CreateEnvironmentOptions) (*Environment, error) {
-	if pythonVersion == "" {
-		pythonVersion = "3.10"
+	return CreateEnvironmentContext(context.Background(), envName, rootDir, pythonVersion, channel, feedback)
+}
+
+// CreateEnvironmentContext is like CreateEnvironment but aborts the micromamba download,
+// the micromamba solver and the version probes when ctx is done.  If the environment is
+// being created and creation fails or is cancelled, the partially created environment
+// directory is removed.
+func CreateEnvironmentContext(ctx context.Context, envName string, rootDir string, pythonVersion string, channel string, feedback CreateEnvironmentOptions) (*Environment, error) {
+	opts := &CreateOptions{
+		PythonVersion: pythonVersion,
+		Feedback:      feedback,
 	}
+	if channel != "" {
+		opts.Channels = []string{channel}
+	}
+	return CreateEnvironmentWithOptions(ctx, envName, rootDir, opts)
+}
+
+// CreateEnvironmentWithOptions creates (or reuses) the named environment under rootDir as
+// configured by opts.  A nil opts is the same as an empty CreateOptions.
+func CreateEnvironmentWithOptions(ctx context.Context, envName string, rootDir string, opts *CreateOptions) (*Environment, error) {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+	env, _, err := createEnvironment(ctx, envName, rootDir, opts, environmentSpec{})
+	return env, err
+}
+
+// environmentSpec is what createEnvironment installs into a new environment
+type environmentSpec struct {
+	packages     []string // Conda specs, opts.Packages if empty.  Any python spec is replaced by the requested constraint.
+	explicitFile string   // Conda explicit spec file of verified cached artifacts, installed offline without solving; packages are then only recorded
+}
 
-	requestedVersion, err := ParseVersion(pythonVersion)
+// createEnvironment creates (or reuses) the named environment, installing spec into a new
+// environment.  It reports whether the environment was created rather than reused.
+func createEnvironment(ctx context.Context, envName string, rootDir string, opts *CreateOptions, spec environmentSpec) (*Environment, bool, error) {
+	pythonVersion := opts.pythonVersion()
+	reporter := opts.reporter()
+	specs := spec.packages
+	if len(specs) == 0 {
+		specs = opts.Packages
+	}
+
+	constraint, err := ParsePythonConstraint(pythonVersion)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing requested python version: %v", err)
+		return nil, false, fmt.Errorf("error parsing requested python version: %v", err)
 	}
 
 	binDirectory := filepath.Join(rootDir, "bin")
@@ -60,287 +207,188 @@ func CreateEnvironment(envName string, rootDir string, pythonVersion string, cha
 	if _, err := os.Stat(binDirectory); os.IsNotExist(err) {
 		// Ensure the target bin directory exists
 		if err := os.MkdirAll(binDirectory, 0755); err != nil {
-			return nil, fmt.Errorf("error creating directory: %v", err)
+			return nil, false, fmt.Errorf("error creating directory: %v", err)
 		}
 	}
 
 	// Check if the specified root directory is writable
 	if !isDirWritable(rootDir) {
-		return nil, fmt.Errorf("root directory is not writable: %s", rootDir)
-	}
-
-	// Detect platform and architecture
-	platform := runtime.GOOS
-	arch := runtime.GOARCH
-	switch arch {
-	case "amd64":
-		arch = "64"
-	case "arm64":
-		if platform == "windows" {
-			// As of now, there is not a separate arm64 download for Windows
-			// We'll use the same download as for amd64
-			arch = "64"
-		}
-	default:
-		return nil, fmt.Errorf("unsupported architecture: %s", arch)
+		return nil, false, fmt.Errorf("root directory is not writable: %s", rootDir)
 	}
 
-	// Convert platform and arch to match micromamba naming
-	var executableName string = "micromamba"
-	if platform == "windows" {
-		executableName += ".exe"
+	// Check the platform and architecture are supported
+	if _, err := micromambaPlatform(); err != nil {
+		return nil, false, err
 	}
 
 	// Create the environment object
 	env := &Environment{
-		Name:           envName,
-		RootDir:        rootDir,
-		MicromambaPath: filepath.Join(binDirectory, executableName),
+		Name:        envName,
+		RootDir:     rootDir,
+		Reporter:    opts.Reporter,
+		HTTPClient:  opts.HTTPClient,
+		ProxyURL:    opts.ProxyURL,
+		CABundle:    opts.CABundle,
+		LockTimeout: opts.LockTimeout,
 	}
 
-	// Check if binDirectory already has micromamba by getting it's version
-	mver, err := RunReadStdout(env.MicromambaPath, "micromamba", "--version")
+	// Use the micromamba in binDirectory, downloading it if needed.  Other processes
+	// using the same root must not download into bin at the same time.
+	rootLock, err := lockFileWait(ctx, rootLockPath(rootDir), true, opts.LockTimeout)
 	if err != nil {
-		_, ok := err.(*fs.PathError)
-		if ok {
-			// download micromamba if it doesn't exist
-			env.MicromambaPath, err = ExpectMicromamba(binDirectory, feedback)
-			if err != nil {
-				return nil, fmt.Errorf("error downloading micromamba: %v", err)
-			}
-			mver, err = RunReadStdout(env.MicromambaPath, "micromamba", "--version")
-			if err != nil {
-				return nil, fmt.Errorf("error running micromamba --version: %v", err)
-			}
-		} else {
-			return nil, fmt.Errorf("error running micromamba --version: %v", err)
-		}
+		return nil, false, fmt.Errorf("error locking root directory: %w", err)
 	}
+	mver, err := ensureMicromamba(ctx, binDirectory, opts, reporter)
+	rootLock.Unlock()
+	if err != nil {
+		return nil, false, err
+	}
+	env.MicromambaPath = micromambaExecutable(binDirectory)
 
 	env.MicromambaVersion, err = ParseVersion(mver)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing micromamba version: %v", err)
+		return nil, false, fmt.Errorf("error parsing micromamba version: %v", err)
+	}
+
+	// hold the environment lock while checking for and creating the environment, so concurrent
+	// processes don't both create it.  A dry run creates nothing and leaves no lock file behind.
+	if !opts.DryRun {
+		envLock, err := env.lockEnv(ctx)
+		if err != nil {
+			return nil, false, err
+		}
+		defer envLock.Unlock()
 	}
 
 	// check if the environment exists
 	envPath := filepath.Join(env.RootDir, "envs", env.Name)
+	created := true
+	createdNow := false
 	if _, err := os.Stat(envPath); os.IsNotExist(err) {
+		created = false
+		if spec.explicitFile == "" {
+			pythonSpec, ok := constraint.condaSpec()
+			if !ok {
+				// the solver can't be given the constraint, so the newest matching python is pinned
+				resolved, err := resolvePythonVersion(ctx, env.MicromambaPath, env.RootDir, constraint, opts)
+				if err != nil {
+					return nil, false, fmt.Errorf("error resolving python version: %w", err)
+				}
+				pythonSpec = "python==" + resolved.String()
+			}
+			// python is solved together with the other packages, the result is checked against the constraint below
+			specs = withPythonSpec(specs, pythonSpec)
+		}
+
 		// Create a new Python environment with micromamba
 		var createEnvCmd *exec.Cmd = nil
-		cmdargs := []string{"--root-prefix", env.RootDir, "create", "-n", env.Name, "python=" + pythonVersion, "-y"}
-		if channel != "" {
-			cmdargs = append(cmdargs, "-c", channel)
+		cmdargs := []string{"--root-prefix", env.RootDir, "create", "-n", env.Name, "-y", "--json"}
+		if spec.explicitFile != "" {
+			// the artifacts were verified into the package cache, nothing may be fetched in their place
+			cmdargs = append(cmdargs, "--file", spec.explicitFile, "--offline")
+		} else {
+			cmdargs = append(cmdargs, specs...)
+			cmdargs = append(cmdargs, opts.channelArgs()...)
+		}
+		if opts.DryRun {
+			cmdargs = append(cmdargs, "--dry-run")
 		}
 
-		createEnvCmd = exec.Command(env.MicromambaPath, cmdargs...)
-
-		// createEnvCmd.Stdout = os.Stdout
-		// createEnvCmd.Stderr = os.Stderr
-		createEnvCmd.Env = append(os.Environ(), "MAMBA_ROOT_PREFIX="+env.RootDir)
-
-		stdout, err := createEnvCmd.StdoutPipe()
+		createEnvCmd = exec.CommandContext(ctx, env.MicromambaPath, cmdargs...)
+		createEnvCmd.Env, err = env.commandEnv()
 		if err != nil {
-			return nil, err
-		}
-		defer stdout.Close()
-
-		var bar *progressbar.ProgressBar = nil
-
-		if feedback == ShowProgressBar || feedback == ShowProgressBarVerbose {
-			bar = progressbar.NewOptions(-1,
-				progressbar.OptionEnableColorCodes(true),
-				progressbar.OptionShowBytes(false),
-				progressbar.OptionSetWidth(15),
-				progressbar.OptionSetDescription("Creating Python environment..."),
-				progressbar.OptionSetTheme(progressbar.Theme{
-					Saucer:        "[green]=[reset]",
-					SaucerHead:    "[green]>[reset]",
-					SaucerPadding: " ",
-					BarStart:      "[",
-					BarEnd:        "]",
-				}))
+			return nil, false, err
 		}
+		createEnvCmd.Env = append(createEnvCmd.Env, "MAMBA_ROOT_PREFIX="+env.RootDir)
 
-		// continue to read the output until there is no more
-		// or an error occurs
-		if err := createEnvCmd.Start(); err != nil {
-			return nil, err
+		// a failure from here on may leave a half-created environment behind
+		defer func() {
+			if !created {
+				os.RemoveAll(envPath)
+			}
+		}()
+
+		const step = "create"
+		reporter.Report(Event{Kind: EventStepStarted, Step: step, Message: "Creating Python environment..."})
+		if spec.explicitFile == "" {
+			reporter.Report(Event{Kind: EventSolveStarted, Step: step})
 		}
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			if bar != nil {
-				// we'll use lines to update the progress bar to show we are working
-				bar.Add(1)
+		transaction, err := runMicromamba(createEnvCmd, reporter, step)
+		if err != nil {
+			if ctx.Err() != nil {
+				err = fmt.Errorf("environment creation cancelled: %v", ctx.Err())
+			} else {
+				err = fmt.Errorf("error creating environment: %w", err)
 			}
-			if feedback == ShowVerbose || feedback == ShowProgressBarVerbose {
-				fmt.Println(scanner.Text())
+			reporter.Report(Event{Kind: EventError, Step: step, Err: err})
+			return nil, false, err
+		}
+		reporter.Report(Event{Kind: EventStepDone, Step: step})
+		env.Transaction = transaction
+		if opts.DryRun {
+			env.EnvPath = envPath
+			return env, false, nil
+		}
+		created = true
+		createdNow = true
+
+		// record how the environment was created
+		resolvedPython := ""
+		for _, p := range transaction.Link {
+			if p.Name == "python" {
+				resolvedPython = p.Version
 			}
 		}
-
-		if bar != nil {
-			bar.Finish()
-			fmt.Println()
+		manifest := &Manifest{
+			Name:              env.Name,
+			PythonVersion:     pythonVersion,
+			ResolvedPython:    resolvedPython,
+			Channels:          opts.Channels,
+			CondaPackages:     specs,
+			MicromambaVersion: env.MicromambaVersion.String(),
+			KindaVersion:      KindaVersion,
+			CreatedAt:         time.Now(),
+		}
+		if err := writeManifest(env.RootDir, manifest); err != nil {
+			return nil, false, fmt.Errorf("error writing environment manifest: %v", err)
 		}
 	}
 
-	// Construct the full paths to the Python and pip executables within the created environment
+	// Fill in the paths and versions from the environment on disk
 	env.EnvPath = envPath
-	if platform == "windows" {
-		env.EnvBinPath = filepath.Join(env.RootDir, "envs", env.Name)
-		env.PythonPath = filepath.Join(env.EnvBinPath, "python.exe")
-		env.PipPath = filepath.Join(env.RootDir, "envs", env.Name, "Scripts", "pip.exe")
-	} else {
-		env.EnvBinPath = filepath.Join(env.RootDir, "envs", env.Name, "bin")
-		env.PythonPath = filepath.Join(env.EnvBinPath, "python")
-		env.PipPath = filepath.Join(env.EnvBinPath, "pip")
-	}
-
-	env.SitePackagesPath = filepath.Join(env.RootDir, "envs", env.Name, "lib", "python"+requestedVersion.MinorString(), "site-packages")
-
-	// find the python lib path
-	env.EnvLibPath = filepath.Join(env.RootDir, "envs", env.Name, "lib")
-	env.PythonLibPath = env.EnvLibPath
-	if platform == "windows" {
-		env.PythonLibPath = filepath.Join(env.RootDir, "envs", env.Name, "python"+requestedVersion.MinorStringCompact()+".dll")
-	} else if platform == "darwin" {
-		env.PythonLibPath = filepath.Join(env.RootDir, "envs", env.Name, "lib", "libpython"+requestedVersion.MinorString()+".dylib")
-	} else {
-		env.PythonLibPath = filepath.Join(env.RootDir, "envs", env.Name, "lib", "libpython"+requestedVersion.MinorString()+".so")
+	if err := env.locate(ctx); err != nil {
+		return nil, false, err
 	}
+	env.Manifest, _ = ReadManifest(env.RootDir, env.Name)
 
-	// find the python headers path
-	env.PythonHeadersPath = filepath.Join(env.RootDir, "envs", env.Name, "include", "python"+requestedVersion.MinorString())
-
-	// Check if the Python executable exists and get its version
-	// C:\Users\johnn\kinda\micromamba\envs\myenv3.10\bin\python.exe
-	// C:\Users\johnn\kinda\micromamba\envs\myenv3.10\python.exe
-	pver, err := RunReadStdout(env.PythonPath, "--version")
-	if err != nil {
-		return nil, fmt.Errorf("error running python --version: %v", err)
-	}
-	env.PythonVersion, err = ParsePythonVersion(pver)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing Python version: %v", err)
-	}
-	// Check if the Python lib exists
-	if _, err := os.Stat(env.PythonLibPath); os.IsNotExist(err) {
-		env.PythonLibPath = ""
-	}
-
-	// Check if the pip executable exists and get its version
-	pipver, err := RunReadStdout(env.PipPath, "--version")
+	// ensure the environment has the python that was asked for, judged by the interpreter's full
+	// version so that a pre-release doesn't pass for the final release
+	installed, err := ParsePEP440Version(env.Interpreter.Version)
 	if err != nil {
-		return nil, fmt.Errorf("error running pip --version: %v", err)
-	}
-	env.PipVersion, err = ParsePipVersion(pipver)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing pip version: %v", err)
-	}
-
-	// ensure the python version is equal or greater than the requested version
-	if env.PythonVersion.Compare(requestedVersion) < 0 {
-		return nil, fmt.Errorf("requested python version %s is not available, found %s", requestedVersion.String(), env.PythonVersion.String())
-	}
-
-	return env, nil
-}
-
-func ExpectMicromamba(binFolder string, feedback CreateEnvironmentOptions) (string, error) {
-	// Detect platform and architecture
-	platform := runtime.GOOS
-	arch := runtime.GOARCH
-
-	// Convert platform and arch to match micromamba naming
-	var executableName string = "micromamba"
-	if platform == "darwin" {
-		platform = "osx"
-	} else if platform == "windows" {
-		platform = "win"
+		installed = env.PythonVersion.pep440()
 	}
-
-	switch arch {
-	case "amd64":
-		arch = "64"
-	case "arm64":
-		if platform == "win" {
-			// As of now, there is not a separate arm64 download for Windows
-			arch = "64"
+	if !constraint.specifiers.Contains(installed) {
+		if createdNow {
+			// don't leave an environment with the wrong python behind
+			created = false
+			os.Remove(manifestPath(env.RootDir, env.Name))
 		}
-	default:
-		return "", fmt.Errorf("unsupported architecture: %s", arch)
-	}
-
-	// Construct the download URL
-	var downloadURL string
-	version := "" // Use this to specify a version, or leave empty for latest
-	// https://github.com/mamba-org/micromamba-releases/releases/download/1.5.7-0/micromamba-osx-arm64
-	if version == "" {
-		downloadURL = fmt.Sprintf("https://github.com/mamba-org/micromamba-releases/releases/latest/download/%s-%s-%s", executableName, platform, arch)
-	} else {
-		downloadURL = fmt.Sprintf("https://github.com/mamba-org/micromamba-releases/releases/download/%s/%s-%s-%s", version, executableName, platform, arch)
-	}
-
-	// Ensure the target bin directory exists
-	if err := os.MkdirAll(binFolder, 0755); err != nil {
-		return "", fmt.Errorf("error creating directory: %v", err)
+		return nil, false, fmt.Errorf("environment has python %s, which does not satisfy %s", installed.String(), constraint.String())
 	}
 
-	// Target binary path
-	if platform == "win" {
-		executableName += ".exe"
-	}
-	binpath := filepath.Join(binFolder, executableName)
-
-	if feedback == ShowVerbose || feedback == ShowProgressBarVerbose {
-		fmt.Printf("Downloading %s to %s\n", downloadURL, binpath)
-	}
-
-	if feedback == ShowProgressBar || feedback == ShowProgressBarVerbose {
-		req, err := http.NewRequest("GET", downloadURL, nil)
-		if err != nil {
-			return "", fmt.Errorf("error creating request: %v", err)
-		}
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return "", fmt.Errorf("error downloading file: %v", err)
-		}
-		defer resp.Body.Close()
-
-		f, _ := os.OpenFile(binpath, os.O_CREATE|os.O_WRONLY, 0755)
-		defer f.Close()
-
-		bar := progressbar.DefaultBytes(
-			resp.ContentLength,
-			"Downloading micromamba",
-		)
-		io.Copy(io.MultiWriter(f, bar), resp.Body)
-	} else {
-		// Download the binary
-		resp, err := http.Get(downloadURL)
-		if err != nil {
-			return "", fmt.Errorf("error downloading file: %v", err)
-		}
-		defer resp.Body.Close()
-
-		outFile, err := os.Create(binpath)
-		if err != nil {
-			return "", fmt.Errorf("error creating file: %v", err)
-		}
-		defer outFile.Close()
-
-		// Write the body to file
-		_, err = io.Copy(outFile, resp.Body)
-		if err != nil {
-			return "", fmt.Errorf("error writing file: %v", err)
-		}
+	return env, createdNow, nil
+}
 
-		// Change file permissions to make it executable (not applicable for Windows)
-		if platform != "windows" {
-			if err := os.Chmod(binpath, 0755); err != nil {
-				return "", fmt.Errorf("error setting file permissions: %v", err)
-			}
+// withPythonSpec returns specs with any python spec replaced by pythonSpec.  A python spec naming
+// a build is already exact and kept as it is.
+func withPythonSpec(specs []string, pythonSpec string) []string {
+	result := []string{pythonSpec}
+	for _, spec := range specs {
+		if specName(spec) != "python" {
+			result = append(result, spec)
+		} else if buildStringRegexp.MatchString(spec) {
+			return specs
 		}
 	}
-
-	return binpath, nil
+	return result
 }
@@ -0,0 +1,255 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// EnvironmentExport captures what an environment contains
+type EnvironmentExport struct {
+	FromHistory *EnvironmentFile // The specs that were asked for, without the packages they pulled in
+	Full        *EnvironmentFile // Every package, pinned to its version and build
+	Lock        *Lockfile        // Every package, pinned to the URL and hash of its artifact
+}
+
+// Export captures the environment as an environment.yml, in from-history and full variants, and as
+// a lockfile.  Exporting needs micromamba, and network access to resolve the URLs of pip packages.
+func (env *Environment) Export() (*EnvironmentExport, error) {
+	return env.ExportContext(context.Background())
+}
+
+// ExportContext is like Export but kills micromamba and pip when ctx is done.
+func (env *Environment) ExportContext(ctx context.Context) (*EnvironmentExport, error) {
+	fromHistory, err := env.ExportEnvironmentFile(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	full, err := env.ExportEnvironmentFile(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := env.ExportLockfile(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &EnvironmentExport{FromHistory: fromHistory, Full: full, Lock: lock}, nil
+}
+
+// ExportEnvironmentFile captures the environment as an environment.yml.  With fromHistory only the
+// specs that were explicitly installed are listed, otherwise every package pinned to its build.
+func (env *Environment) ExportEnvironmentFile(ctx context.Context, fromHistory bool) (*EnvironmentFile, error) {
+	args := []string{"env", "export", "--no-rc", "--prefix", env.EnvPath}
+	if fromHistory {
+		args = append(args, "--from-history")
+	}
+	output, err := env.micromambaOutput(ctx, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error exporting environment: %v", err)
+	}
+	ef, err := ParseEnvironmentFile([]byte(output))
+	if err != nil {
+		return nil, err
+	}
+	ef.Name = env.Name
+
+	// micromamba knows nothing about packages installed by pip
+	if fromHistory && env.Manifest != nil {
+		ef.Pip = append([]string(nil), env.Manifest.PipPackages...)
+	} else {
+		ef.Pip, err = env.pipInstalled(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ef, nil
+}
+
+// ExportLockfile pins every package in the environment to the URL and hash of its artifact.  It
+// fails if a pip package was not installed from an archive, e.g. editable or VCS installs.
+func (env *Environment) ExportLockfile(ctx context.Context) (*Lockfile, error) {
+	platform, err := micromambaPlatform()
+	if err != nil {
+		return nil, err
+	}
+	output, err := env.micromambaOutput(ctx, "env", "export", "--no-rc", "--prefix", env.EnvPath, "--explicit")
+	if err != nil {
+		return nil, fmt.Errorf("error exporting environment: %v", err)
+	}
+	records, err := env.condaRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &Lockfile{Platform: platform}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "@") {
+			continue
+		}
+		url, _, _ := strings.Cut(line, "#")
+		record, ok := records[url]
+		if !ok {
+			return nil, fmt.Errorf("no conda-meta record for %s", url)
+		}
+		lock.Conda = append(lock.Conda, LockedCondaPackage{URL: url, MD5: record.MD5, SHA256: record.SHA256})
+	}
+
+	requirements, err := env.pipInstalled(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lock.Pip, err = env.pipResolveArtifacts(ctx, requirements)
+	if err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// micromambaOutput runs micromamba and returns its standard output.  The error includes what
+// micromamba wrote to stderr.
+func (env *Environment) micromambaOutput(ctx context.Context, args ...string) (string, error) {
+	if env.MicromambaPath == "" {
+		return "", fmt.Errorf("micromamba is not installed in %s", env.RootDir)
+	}
+	return env.commandOutput(ctx, env.MicromambaPath, args...)
+}
+
+// commandOutput runs a micromamba command with the environment's network settings and
+// returns its standard output
+func (env *Environment) commandOutput(ctx context.Context, binPath string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, binPath, args...)
+	var err error
+	cmd.Env, err = env.commandEnv()
+	if err != nil {
+		return "", err
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// condaRecord is the part of a conda-meta/*.json package record kinda needs
+type condaRecord struct {
+	URL      string `json:"url"`
+	Filename string `json:"fn"`
+	MD5      string `json:"md5"`
+	SHA256   string `json:"sha256"`
+	Size     int64  `json:"size"`
+}
+
+// condaRecords returns the records of the conda packages installed in the environment by URL
+func (env *Environment) condaRecords() (map[string]condaRecord, error) {
+	paths, err := filepath.Glob(filepath.Join(env.EnvPath, "conda-meta", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	records := map[string]condaRecord{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading conda-meta: %v", err)
+		}
+		var record condaRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, fmt.Errorf("error decoding %s: %v", path, err)
+		}
+		records[record.URL] = record
+	}
+	return records, nil
+}
+
+var distNameSeparatorRegexp = regexp.MustCompile(`[-_.]+`)
+
+// normalizeDistName normalizes a Python project name as described in PEP 503
+func normalizeDistName(name string) string {
+	return distNameSeparatorRegexp.ReplaceAllString(strings.ToLower(name), "-")
+}
+
+// pipInstallers returns which tool installed each Python distribution in the environment, by
+// normalized project name, from the INSTALLER files of the .dist-info directories
+func (env *Environment) pipInstallers() map[string]string {
+	installers := map[string]string{}
+	for _, dir := range []string{env.SitePackagesPath, env.PlatSitePackagesPath} {
+		if dir == "" {
+			continue
+		}
+		paths, _ := filepath.Glob(filepath.Join(dir, "*.dist-info", "INSTALLER"))
+		for _, path := range paths {
+			distInfo := filepath.Base(filepath.Dir(path))
+			name, _, _ := strings.Cut(strings.TrimSuffix(distInfo, ".dist-info"), "-")
+			installer, err := os.ReadFile(path)
+			if err == nil {
+				installers[normalizeDistName(name)] = strings.TrimSpace(string(installer))
+			}
+		}
+	}
+	return installers
+}
+
+// pipInstalled returns the pip freeze requirements of the packages installed by pip rather than
+// by micromamba
+func (env *Environment) pipInstalled(ctx context.Context) ([]string, error) {
+	output, err := env.pipCommandOutput(ctx, "freeze", "--all", "--disable-pip-version-check")
+	if err != nil {
+		return nil, fmt.Errorf("error running pip freeze: %w", err)
+	}
+	installers := env.pipInstallers()
+	var requirements []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "-") {
+			name := line
+			if i := strings.IndexAny(line, "=@ "); i >= 0 {
+				name = line[:i]
+			}
+			if installers[normalizeDistName(name)] == "conda" {
+				continue
+			}
+		}
+		requirements = append(requirements, line)
+	}
+	return requirements, nil
+}
+
+// pipResolveArtifacts asks pip which artifacts it would install for the requirements, without
+// installing them or their dependencies
+func (env *Environment) pipResolveArtifacts(ctx context.Context, requirements []string) ([]LockedPipPackage, error) {
+	if len(requirements) == 0 {
+		return nil, nil
+	}
+	report, err := env.pipDryRun(ctx, append([]string{"--ignore-installed", "--no-deps"}, requirements...)...)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving pip packages: %w", err)
+	}
+
+	var locked []LockedPipPackage
+	for _, item := range report.Install {
+		info := item.DownloadInfo
+		if info.ArchiveInfo == nil {
+			return nil, fmt.Errorf("cannot lock pip package %s: not installed from an archive (%s)", item.Metadata.Name, info.URL)
+		}
+		sha := info.sha256()
+		if sha == "" {
+			return nil, fmt.Errorf("cannot lock pip package %s: no sha256 for %s", item.Metadata.Name, info.URL)
+		}
+		locked = append(locked, LockedPipPackage{Name: item.Metadata.Name, URL: info.URL, SHA256: sha})
+	}
+	return locked, nil
+}
@@ -0,0 +1,100 @@
+package pkg
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//go:embed scripts/interpreter_info.py
+var interpreterInfoScript string
+
+// InterpreterInfo is what an environment's interpreter reports about itself through sysconfig
+type InterpreterInfo struct {
+	Version        string `json:"version"`        // Full Python version, e.g. "3.13.0rc1"
+	Implementation string `json:"implementation"` // "cpython", "pypy", ...
+	Purelib        string `json:"purelib"`        // site-packages directory for pure Python packages
+	Platlib        string `json:"platlib"`        // site-packages directory for platform specific packages
+	Include        string `json:"include"`        // Directory of the Python headers
+	LibDir         string `json:"libdir"`         // sysconfig LIBDIR, empty on Windows
+	LDLibrary      string `json:"ldlibrary"`      // sysconfig LDLIBRARY, empty on Windows
+	Library        string `json:"library"`        // Path to the Python shared library
+	ExtSuffix      string `json:"ext_suffix"`     // Suffix of extension modules, e.g. ".cpython-312-darwin.so"
+	ABIFlags       string `json:"abiflags"`       // sys.abiflags, e.g. "t" for free-threaded builds
+	GILDisabled    bool   `json:"gil_disabled"`   // Whether this is a free-threaded build
+}
+
+// fileStamp identifies a version of a file without reading it
+type fileStamp struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+func stampFile(path string) (fileStamp, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// interpreterCache is kept in the environment's metadata directory so reopening an environment
+// doesn't need to run Python or pip.  It is valid while both executables are unchanged.
+type interpreterCache struct {
+	Python     fileStamp       `json:"python"`
+	Pip        fileStamp       `json:"pip"`
+	Info       InterpreterInfo `json:"info"`
+	PipVersion string          `json:"pip_version"` // Output of pip --version
+}
+
+// interpreterCachePath returns the file caching what the environment's interpreter reported
+func interpreterCachePath(rootDir string, envName string) string {
+	return filepath.Join(metadataDir(rootDir, envName), "interpreter.json")
+}
+
+// interpreterInfo returns what the environment's interpreter reports about itself and the output of
+// pip --version, from the cache if the executables haven't changed since it was written
+func (env *Environment) interpreterInfo(ctx context.Context) (*InterpreterInfo, string, error) {
+	pythonStamp, err := stampFile(env.PythonPath)
+	if err != nil {
+		return nil, "", err
+	}
+	pipStamp, _ := stampFile(env.PipPath)
+
+	cachePath := interpreterCachePath(env.RootDir, env.Name)
+	if data, err := os.ReadFile(cachePath); err == nil {
+		var cache interpreterCache
+		if json.Unmarshal(data, &cache) == nil && cache.Python.Size == pythonStamp.Size && cache.Python.ModTime.Equal(pythonStamp.ModTime) &&
+			cache.Pip.Size == pipStamp.Size && cache.Pip.ModTime.Equal(pipStamp.ModTime) {
+			return &cache.Info, cache.PipVersion, nil
+		}
+	}
+
+	output, err := RunReadStdoutContext(ctx, env.PythonPath, "-c", interpreterInfoScript)
+	if err != nil {
+		return nil, "", fmt.Errorf("error querying python interpreter: %v", err)
+	}
+	var info InterpreterInfo
+	if err := json.Unmarshal([]byte(output), &info); err != nil {
+		return nil, "", fmt.Errorf("error decoding python interpreter info: %v", err)
+	}
+
+	// Check if the pip executable exists and get its version
+	pipver, err := RunReadStdoutContext(ctx, env.PipPath, "--version")
+	if err != nil {
+		return nil, "", fmt.Errorf("error running pip --version: %v", err)
+	}
+
+	// the cache is only an optimization, failing to write it is not an error
+	cache := interpreterCache{Python: pythonStamp, Pip: pipStamp, Info: info, PipVersion: pipver}
+	if data, err := json.MarshalIndent(&cache, "", "  "); err == nil {
+		if os.MkdirAll(filepath.Dir(cachePath), 0755) == nil {
+			os.WriteFile(cachePath, data, 0644)
+		}
+	}
+	return &info, pipver, nil
+}
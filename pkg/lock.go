@@ -0,0 +1,85 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultLockTimeout is how long kinda waits for another process to release a root or environment lock
+const DefaultLockTimeout = 10 * time.Minute
+
+// ErrLockTimeout is returned when a lock held by another process was not released in time
+var ErrLockTimeout = errors.New("timed out waiting for lock")
+
+// errLocked is returned by tryLockFile when another process holds a conflicting lock
+var errLocked = errors.New("file is locked")
+
+// fileLock is an advisory lock on a file, held until Unlock is called or the process exits
+type fileLock struct {
+	f    *os.File
+	once sync.Once
+}
+
+// tryLockFile creates path if needed and locks it without waiting.  Any number of shared locks
+// may be held at once, but an exclusive lock excludes all others.  It returns errLocked if the
+// lock is held elsewhere.
+func tryLockFile(path string, exclusive bool) (*fileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, exclusive); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileLock{f: f}, nil
+}
+
+// lockFileWait is like tryLockFile but waits up to timeout for a conflicting lock to be released.
+// A timeout of zero means DefaultLockTimeout.
+func lockFileWait(ctx context.Context, path string, exclusive bool, timeout time.Duration) (*fileLock, error) {
+	if timeout <= 0 {
+		timeout = DefaultLockTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	delay := 50 * time.Millisecond
+	for {
+		lock, err := tryLockFile(path, exclusive)
+		if !errors.Is(err, errLocked) {
+			return lock, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w %s after %v", ErrLockTimeout, path, timeout)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		if delay < time.Second {
+			delay *= 2
+		}
+	}
+}
+
+// Unlock releases the lock.  It is safe to call more than once.
+func (l *fileLock) Unlock() {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() {
+		unlockFile(l.f)
+		l.f.Close()
+	})
+}
@@ -0,0 +1,337 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Lockfile pins every package of an environment to the URL of its artifact and the artifact's hash,
+// so the environment can be rebuilt without a solver.  Its text form is a conda explicit spec
+// followed by a pip section in requirements format:
+//
+//	# platform: linux-64
+//	@EXPLICIT
+//	https://conda.anaconda.org/conda-forge/linux-64/python-3.11.8-hab00c5b_0_cpython.conda#sha256:...
+//	@PIP
+//	requests @ https://files.pythonhosted.org/.../requests-2.31.0-py3-none-any.whl --hash=sha256:...
+type Lockfile struct {
+	Platform string               // micromamba platform the packages were built for, e.g. "linux-64"
+	Conda    []LockedCondaPackage // Conda packages in installation order
+	Pip      []LockedPipPackage   // Packages installed by pip on top of the conda packages
+}
+
+// LockedCondaPackage is a conda package pinned to its artifact
+type LockedCondaPackage struct {
+	URL    string // URL of the .conda or .tar.bz2 artifact
+	MD5    string // MD5 of the artifact, hex encoded
+	SHA256 string // SHA-256 of the artifact, hex encoded, may be empty for older channels
+}
+
+// LockedPipPackage is a pip package pinned to its artifact
+type LockedPipPackage struct {
+	Name   string // Project name
+	URL    string // URL of the wheel or sdist
+	SHA256 string // SHA-256 of the wheel or sdist, hex encoded
+}
+
+const (
+	lockfileExplicitMarker = "@EXPLICIT"
+	lockfilePipMarker      = "@PIP"
+	lockfilePlatformLine   = "# platform: "
+)
+
+var (
+	md5Regexp           = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	sha256Regexp        = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	lockedPipLineRegexp = regexp.MustCompile(`^(\S+)\s*@\s*(\S+)\s+--hash=sha256:([0-9a-f]{64})$`)
+)
+
+// Filename returns the file name of the package's artifact
+func (p LockedCondaPackage) Filename() string {
+	return p.URL[strings.LastIndex(p.URL, "/")+1:]
+}
+
+// spec returns the package as an exact conda spec, name=version=build, from its file name
+func (p LockedCondaPackage) spec() (name string, version string, build string, err error) {
+	base := strings.TrimSuffix(strings.TrimSuffix(p.Filename(), ".conda"), ".tar.bz2")
+	parts := strings.Split(base, "-")
+	if len(parts) < 3 {
+		return "", "", "", fmt.Errorf("invalid conda package file name %s", p.Filename())
+	}
+	n := len(parts)
+	return strings.Join(parts[:n-2], "-"), parts[n-2], parts[n-1], nil
+}
+
+// ParseLockfile parses the text form of a lockfile.  Every package must be pinned to a hash.
+func ParseLockfile(data []byte) (*Lockfile, error) {
+	lock := &Lockfile{}
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, lockfilePlatformLine):
+			lock.Platform = strings.TrimSpace(strings.TrimPrefix(line, lockfilePlatformLine))
+		case line == "" || strings.HasPrefix(line, "#"):
+		case line == lockfileExplicitMarker || line == lockfilePipMarker:
+			section = line
+		case section == lockfileExplicitMarker:
+			pkg, err := parseLockedCondaPackage(line)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing lockfile line %d: %v", lineno, err)
+			}
+			lock.Conda = append(lock.Conda, pkg)
+		case section == lockfilePipMarker:
+			m := lockedPipLineRegexp.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("error parsing lockfile line %d: expected \"name @ url --hash=sha256:...\"", lineno)
+			}
+			lock.Pip = append(lock.Pip, LockedPipPackage{Name: m[1], URL: m[2], SHA256: m[3]})
+		default:
+			return nil, fmt.Errorf("error parsing lockfile line %d: package outside of a section", lineno)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading lockfile: %v", err)
+	}
+	return lock, nil
+}
+
+// parseLockedCondaPackage parses a conda explicit spec line, url#md5 or url#sha256:hex
+func parseLockedCondaPackage(line string) (LockedCondaPackage, error) {
+	url, hash, found := strings.Cut(line, "#")
+	if !found {
+		return LockedCondaPackage{}, fmt.Errorf("no hash for %s", url)
+	}
+	pkg := LockedCondaPackage{URL: url}
+	if sha, ok := strings.CutPrefix(hash, "sha256:"); ok && sha256Regexp.MatchString(sha) {
+		pkg.SHA256 = sha
+	} else if md5Regexp.MatchString(hash) {
+		pkg.MD5 = hash
+	} else {
+		return LockedCondaPackage{}, fmt.Errorf("invalid hash %q for %s", hash, url)
+	}
+	return pkg, nil
+}
+
+// ReadLockfile reads and parses a lockfile
+func ReadLockfile(path string) (*Lockfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading lockfile: %v", err)
+	}
+	return ParseLockfile(data)
+}
+
+// Write writes the text form of the lockfile to w.  Conda packages are pinned to their SHA-256
+// when it is known and to their MD5 otherwise.
+func (lock *Lockfile) Write(w io.Writer) error {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "# Generated by kinda %s\n", KindaVersion)
+	fmt.Fprintf(b, "%s%s\n", lockfilePlatformLine, lock.Platform)
+	fmt.Fprintln(b, lockfileExplicitMarker)
+	for _, p := range lock.Conda {
+		if p.SHA256 != "" {
+			fmt.Fprintf(b, "%s#sha256:%s\n", p.URL, p.SHA256)
+		} else {
+			fmt.Fprintf(b, "%s#%s\n", p.URL, p.MD5)
+		}
+	}
+	if len(lock.Pip) > 0 {
+		fmt.Fprintln(b, lockfilePipMarker)
+		for _, p := range lock.Pip {
+			fmt.Fprintf(b, "%s @ %s --hash=sha256:%s\n", p.Name, p.URL, p.SHA256)
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// WriteFile writes the text form of the lockfile to path
+func (lock *Lockfile) WriteFile(path string) error {
+	b := &bytes.Buffer{}
+	if err := lock.Write(b); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing lockfile: %v", err)
+	}
+	return nil
+}
+
+// CreateEnvironmentFromLock creates the named environment under rootDir from a lockfile written by
+// Export, without running the solver.  Every conda and pip artifact is checked against its hash in
+// the lockfile and creation fails if any differs.  Unlike CreateEnvironment it fails if the
+// environment already exists.
+func CreateEnvironmentFromLock(rootDir string, envName string, lockPath string) (*Environment, error) {
+	return CreateEnvironmentFromLockContext(context.Background(), rootDir, envName, lockPath, nil)
+}
+
+// CreateEnvironmentFromLockContext is like CreateEnvironmentFromLock but configured by opts and
+// aborted when ctx is done.  The Python version, packages and channels come from the lockfile,
+// those in opts are ignored.
+func CreateEnvironmentFromLockContext(ctx context.Context, rootDir string, envName string, lockPath string, opts *CreateOptions) (*Environment, error) {
+	if opts != nil && opts.DryRun {
+		return nil, fmt.Errorf("dry run is not supported for lockfiles, the lockfile is the plan")
+	}
+	lock, err := ReadLockfile(lockPath)
+	if err != nil {
+		return nil, err
+	}
+	platform, err := micromambaPlatform()
+	if err != nil {
+		return nil, err
+	}
+	if lock.Platform != platform {
+		return nil, fmt.Errorf("lockfile is for platform %s, not %s", lock.Platform, platform)
+	}
+	envPath := filepath.Join(rootDir, "envs", envName)
+	if _, err := os.Stat(envPath); err == nil {
+		return nil, fmt.Errorf("environment %s already exists", envPath)
+	}
+
+	// don't modify the caller's options
+	lockOpts := CreateOptions{}
+	if opts != nil {
+		lockOpts = *opts
+	}
+	lockOpts.Channels = nil
+	lockOpts.Packages = nil
+	lockOpts.PythonVersion = ""
+	var packages []string
+	for _, p := range lock.Conda {
+		name, version, build, err := p.spec()
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, name+"="+version+"="+build)
+		if name == "python" {
+			lockOpts.PythonVersion = version
+		}
+	}
+	if lockOpts.PythonVersion == "" {
+		return nil, fmt.Errorf("no python package in lockfile %s", lockPath)
+	}
+
+	if err := downloadLockedPackages(ctx, rootDir, lock.Conda, &lockOpts); err != nil {
+		return nil, err
+	}
+
+	// micromamba finds the verified artifacts in its package cache by file name and, being offline,
+	// can't fetch anything else in their place
+	explicit := &bytes.Buffer{}
+	fmt.Fprintln(explicit, lockfileExplicitMarker)
+	for _, p := range lock.Conda {
+		if p.SHA256 != "" {
+			fmt.Fprintf(explicit, "%s#sha256:%s\n", p.URL, p.SHA256)
+		} else {
+			fmt.Fprintf(explicit, "%s#%s\n", p.URL, p.MD5)
+		}
+	}
+	if err := os.MkdirAll(metadataDir(rootDir, envName), 0755); err != nil {
+		return nil, fmt.Errorf("error creating metadata directory: %v", err)
+	}
+	explicitPath := filepath.Join(metadataDir(rootDir, envName), "explicit.txt")
+	if err := os.WriteFile(explicitPath, explicit.Bytes(), 0644); err != nil {
+		return nil, fmt.Errorf("error writing explicit spec: %v", err)
+	}
+	defer os.Remove(explicitPath)
+
+	env, created, err := createEnvironment(ctx, envName, rootDir, &lockOpts, environmentSpec{packages: packages, explicitFile: explicitPath})
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, fmt.Errorf("environment %s already exists", envPath)
+	}
+
+	if len(lock.Pip) > 0 {
+		if err := env.installLockedPip(ctx, lock.Pip, lockOpts.Feedback); err != nil {
+			// a partly installed environment is not what the lockfile describes
+			RemoveEnvironmentContext(context.Background(), rootDir, envName, &RemoveEnvironmentOptions{LockTimeout: lockOpts.LockTimeout})
+			return nil, err
+		}
+	}
+	return env, nil
+}
+
+// downloadLockedPackages downloads the conda packages into micromamba's package cache under
+// rootDir, verifying each against its hashes.  Packages already in the cache are only verified.
+func downloadLockedPackages(ctx context.Context, rootDir string, packages []LockedCondaPackage, opts *CreateOptions) error {
+	client, err := opts.httpClient()
+	if err != nil {
+		return err
+	}
+	cacheDir := filepath.Join(rootDir, "pkgs")
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return fmt.Errorf("error creating package cache: %v", err)
+	}
+
+	// other processes using the same root must not download into the cache at the same time
+	rootLock, err := lockFileWait(ctx, rootLockPath(rootDir), true, opts.LockTimeout)
+	if err != nil {
+		return fmt.Errorf("error locking root directory: %w", err)
+	}
+	defer rootLock.Unlock()
+
+	reporter := opts.reporter()
+	const step = "download packages"
+	reporter.Report(Event{Kind: EventStepStarted, Step: step, Message: fmt.Sprintf("Downloading %d locked packages...", len(packages))})
+	for _, p := range packages {
+		d := &downloadSpec{
+			client:   client,
+			url:      p.URL,
+			dest:     filepath.Join(cacheDir, p.Filename()),
+			sha256:   p.SHA256,
+			md5:      p.MD5,
+			mode:     0644,
+			retries:  opts.downloadRetries(),
+			step:     step,
+			reporter: reporter,
+		}
+		if _, err := os.Stat(d.dest); err == nil {
+			if d.verify(d.dest) == nil {
+				continue
+			}
+			// a cached artifact that differs from the lockfile is replaced
+			os.Remove(d.dest)
+		}
+		if err := downloadFile(ctx, d); err != nil {
+			return err
+		}
+	}
+	reporter.Report(Event{Kind: EventStepDone, Step: step})
+	return nil
+}
+
+// installLockedPip installs the pip packages of a lockfile, refusing any artifact whose hash differs
+func (env *Environment) installLockedPip(ctx context.Context, packages []LockedPipPackage, feedback CreateEnvironmentOptions) error {
+	requirements := &bytes.Buffer{}
+	var installed []string
+	for _, p := range packages {
+		fmt.Fprintf(requirements, "%s @ %s --hash=sha256:%s\n", p.Name, p.URL, p.SHA256)
+		installed = append(installed, p.Name+" @ "+p.URL)
+	}
+	requirementsPath := filepath.Join(metadataDir(env.RootDir, env.Name), "requirements.lock.txt")
+	if err := os.WriteFile(requirementsPath, requirements.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing pip requirements: %v", err)
+	}
+	defer os.Remove(requirementsPath)
+
+	err := env.runPip(ctx, env.reporter(feedback), "Installing locked pip packages...",
+		"install", "--no-warn-script-location", "--require-hashes", "--no-deps", "-r", requirementsPath)
+	if err != nil {
+		return fmt.Errorf("error installing locked pip packages: %w", err)
+	}
+	env.recordInManifest(func(m *Manifest) {
+		m.PipPackages = appendUnique(m.PipPackages, installed...)
+	})
+	return nil
+}
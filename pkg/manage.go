@@ -0,0 +1,182 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// ErrEnvironmentInUse is returned when an environment can't be changed because a PythonProcess is running in it
+var ErrEnvironmentInUse = errors.New("environment is in use")
+
+// EnvironmentSummary describes an environment under a root directory
+type EnvironmentSummary struct {
+	Name          string    // Name of the environment
+	Path          string    // Path to the environment
+	PythonVersion Version   // Version of Python installed in the environment
+	Size          int64     // Size on disk in bytes
+	LastUsed      time.Time // When a PythonProcess was last started in the environment, zero if never
+	InUse         bool      // Whether a PythonProcess is currently running in the environment
+	Manifest      *Manifest // How the environment was created, nil if it has no manifest
+}
+
+// ListEnvironments returns a summary of every environment under rootDir.  It reads what is on disk
+// and runs nothing.
+func ListEnvironments(rootDir string) ([]EnvironmentSummary, error) {
+	entries, err := os.ReadDir(filepath.Join(rootDir, "envs"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading environments: %v", err)
+	}
+
+	var summaries []EnvironmentSummary
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		envPath := filepath.Join(rootDir, "envs", name)
+		summary := EnvironmentSummary{
+			Name: name,
+			Path: envPath,
+		}
+		if m, err := ReadManifest(rootDir, name); err == nil {
+			summary.Manifest = m
+			summary.LastUsed = m.LastUsed
+		}
+		summary.PythonVersion, _ = installedPythonVersion(envPath)
+		summary.Size, err = dirSize(envPath)
+		if err != nil {
+			return nil, fmt.Errorf("error measuring environment %s: %v", name, err)
+		}
+		summary.InUse = environmentInUse(rootDir, name)
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// installedPythonVersion reads the Python version from the environment's conda-meta records
+func installedPythonVersion(envPath string) (Version, error) {
+	matches, err := filepath.Glob(filepath.Join(envPath, "conda-meta", "python-*.json"))
+	if err != nil {
+		return Version{}, err
+	}
+	for _, match := range matches {
+		data, err := os.ReadFile(match)
+		if err != nil {
+			continue
+		}
+		var record struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		}
+		if json.Unmarshal(data, &record) == nil && record.Name == "python" {
+			return ParseVersion(record.Version)
+		}
+	}
+	return Version{}, fmt.Errorf("no python package in %s", envPath)
+}
+
+// dirSize returns the total size of the regular files below path
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// RemoveEnvironment removes an environment and kinda's metadata for it with micromamba env remove.
+// It returns an error wrapping ErrEnvironmentInUse if a PythonProcess is running in the environment.
+func RemoveEnvironment(rootDir string, envName string) error {
+	_, err := RemoveEnvironmentContext(context.Background(), rootDir, envName, nil)
+	return err
+}
+
+// RemoveEnvironmentOptions configures removing an environment
+type RemoveEnvironmentOptions struct {
+	LockTimeout time.Duration // How long to wait for other processes changing the environment, defaults to DefaultLockTimeout
+}
+
+// RemoveEnvironmentContext is like RemoveEnvironment but kills micromamba when ctx is done.
+// It waits up to opts.LockTimeout for other processes changing the environment, and returns what
+// micromamba unlinked, or nil if micromamba is not installed under rootDir.  A nil opts is the
+// same as an empty RemoveEnvironmentOptions.
+func RemoveEnvironmentContext(ctx context.Context, rootDir string, envName string, opts *RemoveEnvironmentOptions) (*Transaction, error) {
+	if opts == nil {
+		opts = &RemoveEnvironmentOptions{}
+	}
+	envPath := filepath.Join(rootDir, "envs", envName)
+	if _, err := os.Stat(envPath); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrEnvironmentNotFound, envPath)
+	}
+
+	envLock, err := lockFileWait(ctx, envLockPath(rootDir, envName), true, opts.LockTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("error locking environment %s: %w", envName, err)
+	}
+	defer envLock.Unlock()
+
+	// holding the use lock exclusively keeps new PythonProcesses out while removing
+	useLock, err := tryLockFile(useLockPath(rootDir, envName), true)
+	if errors.Is(err, errLocked) {
+		return nil, fmt.Errorf("%w: %s", ErrEnvironmentInUse, envName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error locking environment: %v", err)
+	}
+	defer useLock.Unlock()
+
+	var transaction *Transaction
+	mambaPath := micromambaExecutable(filepath.Join(rootDir, "bin"))
+	if _, err := os.Stat(mambaPath); err == nil {
+		cmd := exec.CommandContext(ctx, mambaPath, "--root-prefix", rootDir, "env", "remove", "-n", envName, "-y", "--json")
+		cmd.Env = append(os.Environ(), "MAMBA_ROOT_PREFIX="+rootDir)
+		transaction, err = runMicromamba(cmd, nopReporter{}, "remove")
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("environment removal cancelled: %v", ctx.Err())
+			}
+			return nil, fmt.Errorf("error removing environment: %w", err)
+		}
+	}
+
+	// micromamba leaves behind files it didn't install, and without micromamba there is nothing else to do
+	if err := os.RemoveAll(envPath); err != nil {
+		return nil, fmt.Errorf("error removing environment directory: %v", err)
+	}
+	// env.lock stays, other processes may already be waiting on it
+	useLock.Unlock()
+	metaDir := metadataDir(rootDir, envName)
+	entries, err := os.ReadDir(metaDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error removing environment metadata: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.Name() == filepath.Base(envLockPath(rootDir, envName)) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(metaDir, entry.Name())); err != nil {
+			return nil, fmt.Errorf("error removing environment metadata: %v", err)
+		}
+	}
+	return transaction, nil
+}
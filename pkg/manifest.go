@@ -0,0 +1,166 @@
+package pkg
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// KindaVersion is the version of kinda, recorded in the manifest of every environment it creates
+const KindaVersion = "0.2.0"
+
+// Manifest records how an environment was created and changed, so it can be audited,
+// reproduced and garbage collected.  kinda keeps it in kinda.json in the environment's
+// metadata directory.
+type Manifest struct {
+	Name              string    `json:"name"`               // Name of the environment
+	PythonVersion     string    `json:"python_version"`     // Python version requested at creation
+	ResolvedPython    string    `json:"resolved_python"`    // Exact Python version selected for PythonVersion at creation
+	Channels          []string  `json:"channels"`           // Channels packages were installed from
+	CondaPackages     []string  `json:"conda_packages"`     // Conda specs installed, including python
+	PipPackages       []string  `json:"pip_packages"`       // Pip requirements installed
+	PipIndexes        []string  `json:"pip_indexes"`        // Package indexes given to pip, in addition to its configuration
+	PipFindLinks      []string  `json:"pip_find_links"`     // Find-links locations given to pip
+	PipConstraints    []string  `json:"pip_constraints"`    // Constraint files given to pip
+	MicromambaVersion string    `json:"micromamba_version"` // Version of micromamba that created the environment
+	KindaVersion      string    `json:"kinda_version"`      // Version of kinda that created the environment
+	CreatedAt         time.Time `json:"created_at"`         // When the environment was created
+	LastUsed          time.Time `json:"last_used"`          // When a PythonProcess was last started in the environment
+}
+
+// manifestPath returns the path of an environment's kinda.json
+func manifestPath(rootDir string, envName string) string {
+	return filepath.Join(metadataDir(rootDir, envName), "kinda.json")
+}
+
+// ReadManifest reads the manifest of an environment.  Environments created by older versions
+// of kinda have no manifest, in which case the returned error satisfies os.IsNotExist.
+func ReadManifest(rootDir string, envName string) (*Manifest, error) {
+	data, err := os.ReadFile(manifestPath(rootDir, envName))
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %v", err)
+	}
+	return &m, nil
+}
+
+// writeManifest atomically replaces an environment's kinda.json
+func writeManifest(rootDir string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := manifestPath(rootDir, m.Name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// manifestLockPath returns the lock file serializing updates to an environment's manifest
+func manifestLockPath(rootDir string, envName string) string {
+	return filepath.Join(metadataDir(rootDir, envName), "manifest.lock")
+}
+
+// updateManifest applies update to an environment's manifest, creating the manifest if the
+// environment has none.  Updates from concurrent processes are serialized.
+func updateManifest(rootDir string, envName string, update func(m *Manifest)) (*Manifest, error) {
+	lock, err := lockFileWait(context.Background(), manifestLockPath(rootDir, envName), true, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	return applyManifestUpdate(rootDir, envName, update)
+}
+
+// applyManifestUpdate reads, updates and writes a manifest.  The caller holds the manifest lock.
+func applyManifestUpdate(rootDir string, envName string, update func(m *Manifest)) (*Manifest, error) {
+	m, err := ReadManifest(rootDir, envName)
+	if os.IsNotExist(err) {
+		m, err = &Manifest{Name: envName}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	update(m)
+	if err := writeManifest(rootDir, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// recordInManifest updates the environment's manifest after a change, keeping env.Manifest current.
+// The manifest is bookkeeping, so failing to update it doesn't fail the change.
+func (env *Environment) recordInManifest(update func(m *Manifest)) {
+	if m, err := updateManifest(env.RootDir, env.Name, update); err == nil {
+		env.Manifest = m
+	}
+}
+
+// recordLastUsed sets LastUsed in the environment's manifest.  It runs on every process start,
+// so it never waits: while another process is updating the manifest the update is skipped.
+func (env *Environment) recordLastUsed() {
+	lock, err := tryLockFile(manifestLockPath(env.RootDir, env.Name), true)
+	if err != nil {
+		return
+	}
+	defer lock.Unlock()
+	if m, err := applyManifestUpdate(env.RootDir, env.Name, func(m *Manifest) {
+		m.LastUsed = time.Now()
+	}); err == nil {
+		env.Manifest = m
+	}
+}
+
+// appendUnique appends the values that are not already in list
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, existing := range list {
+			if existing == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// readRequirements returns the requirement lines of a requirements file, without comments, blank
+// lines and option lines such as "-r other.txt", "--index-url ..." or "-e ."
+func readRequirements(requirementsPath string) ([]string, error) {
+	f, err := os.Open(requirementsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var requirements []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "-") {
+			requirements = append(requirements, line)
+		}
+	}
+	return requirements, scanner.Err()
+}
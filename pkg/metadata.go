@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// kinda keeps its own files for an environment outside of the environment prefix, in
+// <root>/.kinda/envs/<name>, so that they can exist before micromamba creates the prefix
+// and don't get in micromamba's way.
+
+// metadataDir returns the directory holding kinda's files for an environment
+func metadataDir(rootDir string, envName string) string {
+	return filepath.Join(rootDir, ".kinda", "envs", envName)
+}
+
+// rootLockPath returns the lock file serializing changes to the root itself, e.g. installing micromamba
+func rootLockPath(rootDir string) string {
+	return filepath.Join(rootDir, ".kinda", "root.lock")
+}
+
+// envLockPath returns the lock file serializing changes to an environment
+func envLockPath(rootDir string, envName string) string {
+	return filepath.Join(metadataDir(rootDir, envName), "env.lock")
+}
+
+// useLockPath returns the lock file held shared by every running PythonProcess of an environment,
+// and exclusively while the environment is removed
+func useLockPath(rootDir string, envName string) string {
+	return filepath.Join(metadataDir(rootDir, envName), "use.lock")
+}
+
+// processLockDir returns the directory holding a lock file for each running PythonProcess of an
+// environment, locked exclusively by its process
+func processLockDir(rootDir string, envName string) string {
+	return filepath.Join(metadataDir(rootDir, envName), "processes")
+}
+
+// lockEnv waits for exclusive access to change the environment, e.g. to install packages.
+// The lock must be released with Unlock.
+func (env *Environment) lockEnv(ctx context.Context) (*fileLock, error) {
+	lock, err := lockFileWait(ctx, envLockPath(env.RootDir, env.Name), true, env.LockTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("error locking environment %s: %w", env.Name, err)
+	}
+	return lock, nil
+}
+
+// useLock marks an environment as in use by one PythonProcess
+type useLock struct {
+	shared  *fileLock // on useLockPath, keeps RemoveEnvironment out
+	process *fileLock // on the process's own file in processLockDir, tells ListEnvironments it runs
+}
+
+// Unlock releases the locks and removes the process's lock file.  It is safe to call more than once.
+func (l *useLock) Unlock() {
+	if l == nil {
+		return
+	}
+	l.process.Unlock()
+	os.Remove(l.process.f.Name())
+	l.shared.Unlock()
+}
+
+// acquireUseLock marks the environment as in use until the returned lock is released,
+// and records the time it was last used unless another process is updating the manifest
+func (env *Environment) acquireUseLock() (*useLock, error) {
+	shared, err := tryLockFile(useLockPath(env.RootDir, env.Name), false)
+	if err != nil {
+		return nil, err
+	}
+	dir := processLockDir(env.RootDir, env.Name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		shared.Unlock()
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, "*.lock")
+	if err == nil {
+		// nobody else knows the new file yet, so this can't be refused
+		err = lockFile(f, true)
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		shared.Unlock()
+		return nil, err
+	}
+	env.recordLastUsed()
+	return &useLock{shared: shared, process: &fileLock{f: f}}, nil
+}
+
+// environmentInUse reports whether a PythonProcess is running in an environment.  The process
+// lock files are probed with shared locks, which never get in the way of a process starting.
+func environmentInUse(rootDir string, envName string) bool {
+	paths, _ := filepath.Glob(filepath.Join(processLockDir(rootDir, envName), "*.lock"))
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			// the process ended since the glob
+			continue
+		}
+		err = lockFile(f, false)
+		if err == nil {
+			unlockFile(f)
+		}
+		f.Close()
+		if errors.Is(err, errLocked) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,28 +1,228 @@
 package pkg
 
 import (
+	"context"
 	"fmt"
-	"os"
 	"os/exec"
+	"strings"
 )
 
+// MicromambaInstallOptions configures installing and updating conda packages with micromamba
+type MicromambaInstallOptions struct {
+	Channels         []string                 // Channels to install from, in priority order
+	ChannelPriority  ChannelPriority          // How the solver weighs Channels
+	OverrideChannels bool                     // Use only Channels, ignoring micromamba's configuration
+	FreezeInstalled  bool                     // Don't update or change installed packages, micromamba's --freeze-installed
+	NoUpdateDeps     bool                     // Don't update installed dependencies of the requested packages, micromamba's --no-update-deps
+	DryRun           bool                     // Only solve, the returned transaction is what would be done
+	Feedback         CreateEnvironmentOptions // User feedback, unless the environment has a Reporter
+}
+
+// args returns the micromamba arguments for the options
+func (opts *MicromambaInstallOptions) args() []string {
+	args := channelArgs(opts.Channels, opts.ChannelPriority, opts.OverrideChannels)
+	if opts.FreezeInstalled {
+		args = append(args, "--freeze-installed")
+	}
+	if opts.NoUpdateDeps {
+		args = append(args, "--no-update-deps")
+	}
+	return args
+}
+
+// MicromambaInstallPackage installs a conda package into the environment with micromamba.
 // micromamba commands need to have rc files disabled and prefix specified
 func (env *Environment) MicromambaInstallPackage(packageToInstall string, channel string) error {
-	var installCmd *exec.Cmd
+	_, err := env.MicromambaInstallPackageContext(context.Background(), packageToInstall, channel)
+	return err
+}
+
+// MicromambaInstallPackageContext is like MicromambaInstallPackage but kills micromamba when ctx is done.
+// It returns what micromamba did to the environment.  If the specs cannot be solved the error
+// wraps a *SolverError, other micromamba failures wrap a *MicromambaError.
+func (env *Environment) MicromambaInstallPackageContext(ctx context.Context, packageToInstall string, channel string) (*Transaction, error) {
+	return env.MicromambaInstallPackages(ctx, []string{packageToInstall}, singleChannelInstallOptions(channel, false))
+}
+
+// MicromambaInstallPackageDryRun solves installing a conda package without changing the environment
+// and returns what the install would do.
+func (env *Environment) MicromambaInstallPackageDryRun(ctx context.Context, packageToInstall string, channel string) (*TransactionPlan, error) {
+	transaction, err := env.MicromambaInstallPackages(ctx, []string{packageToInstall}, singleChannelInstallOptions(channel, true))
+	if err != nil {
+		return nil, err
+	}
+	return transaction.Plan(), nil
+}
+
+// singleChannelInstallOptions returns the options of the single package install methods, which
+// print micromamba's output unless the environment has a Reporter
+func singleChannelInstallOptions(channel string, dryRun bool) *MicromambaInstallOptions {
+	opts := &MicromambaInstallOptions{DryRun: dryRun, Feedback: ShowVerbose}
 	if channel != "" {
-		/*
-			cd /Users/richardinsley/Projects/comfycli/kinda/tests/mlx/micromamba/envs/myenv3.10
-			../../bin/micromamba install --no-rc -c conda-forge -y --prefix /Users/richardinsley/Projects/comfycli/kinda/tests/mlx/micromamba/envs/myenv3.10 mlx
-		*/
-		installCmd = exec.Command(env.MicromambaPath, "install", "--no-rc", "-c", channel, "--prefix", env.EnvPath, "-y", packageToInstall)
-	} else {
-		installCmd = exec.Command(env.MicromambaPath, "install", "--no-rc", "--prefix", env.EnvPath, "-y", packageToInstall)
+		opts.Channels = []string{channel}
+	}
+	return opts
+}
+
+// MicromambaInstallPackages installs conda match specs, e.g. "numpy>=1.26" or "conda-forge::ffmpeg",
+// into the environment in a single solve.  A nil opts is the same as an empty MicromambaInstallOptions.
+// If the specs cannot be solved the error wraps a *SolverError, other micromamba failures wrap a
+// *MicromambaError.
+func (env *Environment) MicromambaInstallPackages(ctx context.Context, specs []string, opts *MicromambaInstallOptions) (*Transaction, error) {
+	if opts == nil {
+		opts = &MicromambaInstallOptions{}
+	}
+	/*
+		cd /Users/richardinsley/Projects/comfycli/kinda/tests/mlx/micromamba/envs/myenv3.10
+		../../bin/micromamba install --no-rc -c conda-forge -y --prefix /Users/richardinsley/Projects/comfycli/kinda/tests/mlx/micromamba/envs/myenv3.10 mlx
+	*/
+	args := append([]string{"install"}, opts.args()...)
+	description := "Installing conda packages..."
+	if len(specs) == 1 {
+		description = fmt.Sprintf("Installing conda package %s...", specs[0])
+	}
+	transaction, err := env.micromambaTransaction(ctx, "micromamba install", description, opts.Feedback, opts.DryRun, append(args, specs...)...)
+	if err != nil {
+		return nil, fmt.Errorf("error installing package: %w", err)
+	}
+	if !opts.DryRun {
+		env.recordInManifest(func(m *Manifest) {
+			m.CondaPackages = appendUnique(m.CondaPackages, specs...)
+			m.Channels = appendUnique(m.Channels, opts.Channels...)
+		})
+	}
+	return transaction, nil
+}
+
+// MicromambaUpdatePackages updates installed conda packages to the newest versions the specs allow.
+// A nil opts is the same as an empty MicromambaInstallOptions.
+func (env *Environment) MicromambaUpdatePackages(ctx context.Context, specs []string, opts *MicromambaInstallOptions) (*Transaction, error) {
+	if opts == nil {
+		opts = &MicromambaInstallOptions{}
+	}
+	args := append([]string{"update"}, opts.args()...)
+	transaction, err := env.micromambaTransaction(ctx, "micromamba update", "Updating conda packages...", opts.Feedback, opts.DryRun, append(args, specs...)...)
+	if err != nil {
+		return nil, fmt.Errorf("error updating packages: %w", err)
+	}
+	return transaction, nil
+}
+
+// MicromambaUpdateAll updates every conda package in the environment.  A nil opts is the same as an
+// empty MicromambaInstallOptions.
+func (env *Environment) MicromambaUpdateAll(ctx context.Context, opts *MicromambaInstallOptions) (*Transaction, error) {
+	if opts == nil {
+		opts = &MicromambaInstallOptions{}
+	}
+	args := append([]string{"update", "--all"}, opts.args()...)
+	transaction, err := env.micromambaTransaction(ctx, "micromamba update", "Updating all conda packages...", opts.Feedback, opts.DryRun, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error updating packages: %w", err)
 	}
+	return transaction, nil
+}
 
-	installCmd.Stdout = os.Stdout
-	installCmd.Stderr = os.Stderr
-	if err := installCmd.Run(); err != nil {
-		return fmt.Errorf("error installing package: %v", err)
+// MicromambaRemoveOptions configures removing conda packages with micromamba
+type MicromambaRemoveOptions struct {
+	Force    bool                     // Remove only the named packages, even if installed packages depend on them
+	DryRun   bool                     // Only solve, the returned transaction is what would be done
+	Feedback CreateEnvironmentOptions // User feedback, unless the environment has a Reporter
+}
+
+// MicromambaRemovePackages removes conda packages, and the packages depending on them, from the
+// environment.  A nil opts is the same as an empty MicromambaRemoveOptions.
+func (env *Environment) MicromambaRemovePackages(ctx context.Context, packages []string, opts *MicromambaRemoveOptions) (*Transaction, error) {
+	if opts == nil {
+		opts = &MicromambaRemoveOptions{}
+	}
+	args := []string{"remove"}
+	if opts.Force {
+		args = append(args, "--force")
+	}
+	transaction, err := env.micromambaTransaction(ctx, "micromamba remove", "Removing conda packages...", opts.Feedback, opts.DryRun, append(args, packages...)...)
+	if err != nil {
+		return nil, fmt.Errorf("error removing packages: %w", err)
+	}
+	if !opts.DryRun {
+		removed := map[string]bool{}
+		for _, p := range transaction.Unlink {
+			removed[p.Name] = true
+		}
+		for _, p := range transaction.Link {
+			delete(removed, p.Name)
+		}
+		env.recordInManifest(func(m *Manifest) {
+			var kept []string
+			for _, spec := range m.CondaPackages {
+				if !removed[specName(spec)] {
+					kept = append(kept, spec)
+				}
+			}
+			m.CondaPackages = kept
+		})
+	}
+	return transaction, nil
+}
+
+// micromambaTransaction runs a micromamba command changing the environment's prefix as a single
+// step and returns the transaction it reports.  args start with the subcommand.
+func (env *Environment) micromambaTransaction(ctx context.Context, step string, description string, feedback CreateEnvironmentOptions, dryRun bool, args ...string) (*Transaction, error) {
+	args = append([]string{args[0], "--no-rc", "--prefix", env.EnvPath, "-y", "--json"}, args[1:]...)
+	if dryRun {
+		args = append(args, "--dry-run")
+	}
+	cmd := exec.CommandContext(ctx, env.MicromambaPath, args...)
+	var err error
+	cmd.Env, err = env.commandEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := env.lockEnv(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	reporter := env.reporter(feedback)
+	reporter.Report(Event{Kind: EventStepStarted, Step: step, Message: description})
+	transaction, err := runMicromamba(cmd, reporter, step)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("micromamba cancelled: %v", ctx.Err())
+		}
+		reporter.Report(Event{Kind: EventError, Step: step, Err: err})
+		return nil, err
+	}
+	reporter.Report(Event{Kind: EventStepDone, Step: step})
+	return transaction, nil
+}
+
+// channelArgs returns the micromamba arguments selecting channels
+func channelArgs(channels []string, priority ChannelPriority, override bool) []string {
+	var args []string
+	for _, channel := range channels {
+		args = append(args, "-c", channel)
+	}
+	switch priority {
+	case ChannelPriorityStrict:
+		args = append(args, "--strict-channel-priority")
+	case ChannelPriorityDisabled:
+		args = append(args, "--no-channel-priority")
+	}
+	if override {
+		args = append(args, "--override-channels")
+	}
+	return args
+}
+
+// specName returns the package name of a conda match spec, e.g. "numpy" for "conda-forge::numpy>=1.26"
+func specName(spec string) string {
+	if i := strings.LastIndex(spec, "::"); i >= 0 {
+		spec = spec[i+2:]
+	}
+	if i := strings.IndexAny(spec, "=<>!~ [*"); i >= 0 {
+		spec = spec[:i]
 	}
-	return nil
+	return spec
 }
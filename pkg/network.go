@@ -0,0 +1,141 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// newHTTPClient returns an http.Client that uses proxyURL and trusts the certificates in
+// caBundle in addition to the system roots.  With neither set it returns http.DefaultClient.
+func newHTTPClient(proxyURL string, caBundle string) (*http.Client, error) {
+	if proxyURL == "" && caBundle == "" {
+		return http.DefaultClient, nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	if caBundle != "" {
+		pem, err := os.ReadFile(caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA bundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", caBundle)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// systemCABundles are the usual locations of the PEM file holding the system's trusted certificates
+var systemCABundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",                // Debian, Ubuntu, Arch
+	"/etc/pki/tls/certs/ca-bundle.crt",                  // Fedora, RHEL
+	"/etc/ssl/ca-bundle.pem",                            // openSUSE
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // CentOS
+	"/etc/ssl/cert.pem",                                 // macOS, Alpine, BSDs
+}
+
+// combinedCABundle returns the path of a PEM file in rootDir holding the system's trusted
+// certificates followed by the ones in caBundle.  Child processes are pointed at it, because
+// micromamba and pip replace their trust store with the file they are given, while kinda's
+// own client adds caBundle to the system roots.  Where the system keeps no PEM file, as on
+// Windows, the file only holds caBundle.
+func combinedCABundle(rootDir string, caBundle string) (string, error) {
+	extra, err := os.ReadFile(caBundle)
+	if err != nil {
+		return "", fmt.Errorf("error reading CA bundle: %v", err)
+	}
+	candidates := systemCABundles
+	if file := os.Getenv("SSL_CERT_FILE"); file != "" {
+		candidates = []string{file}
+	}
+	var combined []byte
+	for _, candidate := range candidates {
+		if system, err := os.ReadFile(candidate); err == nil {
+			combined = append(system, '\n')
+			break
+		}
+	}
+	combined = append(combined, extra...)
+
+	// named after its content, so concurrent processes agree on it and never rewrite it
+	sum := sha256.Sum256(combined)
+	path := filepath.Join(rootDir, ".kinda", "ca-bundle-"+hex.EncodeToString(sum[:8])+".pem")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", fmt.Errorf("error creating directory: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "ca-bundle-*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("error writing CA bundle: %v", err)
+	}
+	_, err = tmp.Write(combined)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("error writing CA bundle: %v", err)
+	}
+	return path, nil
+}
+
+// networkEnv returns the environment variables that make micromamba and pip use proxyURL
+// and trust caBundle in addition to the system's certificates
+func networkEnv(rootDir string, proxyURL string, caBundle string) ([]string, error) {
+	var vars []string
+	if proxyURL != "" {
+		// libcurl (micromamba) only honours the lower case http_proxy
+		vars = append(vars,
+			"http_proxy="+proxyURL,
+			"https_proxy="+proxyURL,
+			"HTTP_PROXY="+proxyURL,
+			"HTTPS_PROXY="+proxyURL,
+		)
+	}
+	if caBundle != "" {
+		bundle, err := combinedCABundle(rootDir, caBundle)
+		if err != nil {
+			return nil, err
+		}
+		vars = append(vars,
+			"MAMBA_SSL_VERIFY="+bundle,
+			"PIP_CERT="+bundle,
+			"REQUESTS_CA_BUNDLE="+bundle,
+			"SSL_CERT_FILE="+bundle,
+		)
+	}
+	return vars, nil
+}
+
+// commandEnv returns the environment for micromamba and pip child processes of env
+func (env *Environment) commandEnv() ([]string, error) {
+	vars, err := networkEnv(env.RootDir, env.ProxyURL, env.CABundle)
+	if err != nil {
+		return nil, err
+	}
+	return append(os.Environ(), vars...), nil
+}
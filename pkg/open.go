@@ -0,0 +1,104 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// ErrEnvironmentNotFound is returned when an environment does not exist under the root directory
+var ErrEnvironmentNotFound = errors.New("environment not found")
+
+// OpenEnvironment attaches to an existing environment under rootDir.  Unlike CreateEnvironment it
+// never downloads micromamba or creates anything; if the environment does not exist the returned
+// error wraps ErrEnvironmentNotFound.
+func OpenEnvironment(rootDir string, envName string) (*Environment, error) {
+	return OpenEnvironmentContext(context.Background(), rootDir, envName)
+}
+
+// OpenEnvironmentContext is like OpenEnvironment but kills the version probes when ctx is done.
+func OpenEnvironmentContext(ctx context.Context, rootDir string, envName string) (*Environment, error) {
+	env := &Environment{
+		Name:    envName,
+		RootDir: rootDir,
+		EnvPath: filepath.Join(rootDir, "envs", envName),
+	}
+	if fi, err := os.Stat(env.EnvPath); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("%w: %s", ErrEnvironmentNotFound, env.EnvPath)
+	}
+
+	// micromamba is optional when only running Python
+	mambaPath := micromambaExecutable(filepath.Join(rootDir, "bin"))
+	if _, err := os.Stat(mambaPath); err == nil {
+		env.MicromambaPath = mambaPath
+		mver, err := RunReadStdoutContext(ctx, mambaPath, "--version")
+		if err != nil {
+			return nil, fmt.Errorf("error running micromamba --version: %v", err)
+		}
+		env.MicromambaVersion, err = ParseVersion(mver)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing micromamba version: %v", err)
+		}
+	}
+
+	if err := env.locate(ctx); err != nil {
+		return nil, err
+	}
+	env.Manifest, _ = ReadManifest(rootDir, envName)
+	return env, nil
+}
+
+// locate fills in the paths within env.EnvPath and the Python and pip versions from what the
+// environment's interpreter reports, cached in the environment's metadata
+func (env *Environment) locate(ctx context.Context) error {
+	platform := runtime.GOOS
+
+	// Construct the full paths to the Python and pip executables within the environment
+	if platform == "windows" {
+		env.EnvBinPath = env.EnvPath
+		env.PythonPath = filepath.Join(env.EnvBinPath, "python.exe")
+		env.PipPath = filepath.Join(env.EnvPath, "Scripts", "pip.exe")
+	} else {
+		env.EnvBinPath = filepath.Join(env.EnvPath, "bin")
+		env.PythonPath = filepath.Join(env.EnvBinPath, "python")
+		env.PipPath = filepath.Join(env.EnvBinPath, "pip")
+	}
+
+	// Check if the Python executable exists and get its version
+	// C:\Users\johnn\kinda\micromamba\envs\myenv3.10\bin\python.exe
+	// C:\Users\johnn\kinda\micromamba\envs\myenv3.10\python.exe
+	if _, err := os.Stat(env.PythonPath); os.IsNotExist(err) {
+		return fmt.Errorf("%w: no python executable in %s", ErrEnvironmentNotFound, env.EnvPath)
+	}
+	info, pipver, err := env.interpreterInfo(ctx)
+	if err != nil {
+		return err
+	}
+	env.Interpreter = *info
+	env.PythonVersion, err = ParseVersion(info.Version)
+	if err != nil {
+		return fmt.Errorf("error parsing Python version: %v", err)
+	}
+
+	// use the interpreter's own answers rather than guessing the layout from the version, it
+	// differs between platforms, free-threaded builds and implementations
+	env.SitePackagesPath = info.Purelib
+	env.PlatSitePackagesPath = info.Platlib
+	env.PythonHeadersPath = info.Include
+	env.EnvLibPath = filepath.Join(env.EnvPath, "lib")
+
+	// Check if the Python lib exists
+	env.PythonLibPath = info.Library
+	if _, err := os.Stat(env.PythonLibPath); env.PythonLibPath == "" || os.IsNotExist(err) {
+		env.PythonLibPath = ""
+	}
+
+	env.PipVersion, err = ParsePipVersion(pipver)
+	if err != nil {
+		return fmt.Errorf("error parsing pip version: %v", err)
+	}
+	return nil
+}
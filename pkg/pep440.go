@@ -0,0 +1,404 @@
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PEP440Version is a Python package version as defined by PEP 440, e.g. "1!2.0.1rc1.post2.dev3+local.1"
+type PEP440Version struct {
+	Epoch     int    // Version epoch, 0 if not given
+	Release   []int  // Release components, e.g. [3, 13, 0]
+	PreLabel  string // "a", "b" or "rc" for pre-releases, "" otherwise
+	PreNumber int    // Number of the pre-release
+	Post      int    // Post-release number, -1 if not a post-release
+	Dev       int    // Development release number, -1 if not a development release
+	Local     string // Local version label, normalized to dot separated lower case, e.g. "ubuntu.1"
+
+	original string // The version as parsed, compared by "==="
+}
+
+// pep440Regexp matches the versions PEP 440 allows, including the alternative spellings it normalizes
+var pep440Regexp = regexp.MustCompile(`(?i)^v?` +
+	`(?:(\d+)!)?` + // epoch
+	`(\d+(?:\.\d+)*)` + // release
+	`(?:[-_.]?(a|b|c|rc|alpha|beta|pre|preview)[-_.]?(\d+)?)?` + // pre-release
+	`(?:-(\d+)|[-_.]?(post|rev|r)[-_.]?(\d+)?)?` + // post-release
+	`(?:[-_.]?(dev)[-_.]?(\d+)?)?` + // development release
+	`(?:\+([a-z0-9]+(?:[-_.][a-z0-9]+)*))?$`) // local version
+
+// ParsePEP440Version parses a version string following PEP 440
+func ParsePEP440Version(versionStr string) (PEP440Version, error) {
+	m := pep440Regexp.FindStringSubmatch(strings.TrimSpace(versionStr))
+	if m == nil {
+		return PEP440Version{}, fmt.Errorf("invalid PEP 440 version %q", versionStr)
+	}
+	v := PEP440Version{Post: -1, Dev: -1, original: strings.TrimSpace(versionStr)}
+	// the regexp only lets digits through, Atoi can only fail on overflow
+	number := func(s string) int {
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	v.Epoch = number(m[1])
+	for _, c := range strings.Split(m[2], ".") {
+		v.Release = append(v.Release, number(c))
+	}
+	if m[3] != "" {
+		switch strings.ToLower(m[3]) {
+		case "a", "alpha":
+			v.PreLabel = "a"
+		case "b", "beta":
+			v.PreLabel = "b"
+		default:
+			v.PreLabel = "rc"
+		}
+		v.PreNumber = number(m[4])
+	}
+	if m[5] != "" {
+		v.Post = number(m[5])
+	} else if m[6] != "" {
+		v.Post = number(m[7])
+	}
+	if m[8] != "" {
+		v.Dev = number(m[9])
+	}
+	if m[10] != "" {
+		v.Local = strings.ToLower(strings.NewReplacer("-", ".", "_", ".").Replace(m[10]))
+	}
+	return v, nil
+}
+
+// IsPrerelease reports whether the version is a pre-release or development release
+func (v PEP440Version) IsPrerelease() bool {
+	return v.PreLabel != "" || v.Dev != -1
+}
+
+// IsPostrelease reports whether the version is a post-release
+func (v PEP440Version) IsPostrelease() bool {
+	return v.Post != -1
+}
+
+// Public returns the version without its local label
+func (v PEP440Version) Public() PEP440Version {
+	v.Local = ""
+	v.original = ""
+	return v
+}
+
+// BaseVersion returns the epoch and release of the version, e.g. 1.2.0 for 1.2.0rc1.post1
+func (v PEP440Version) BaseVersion() PEP440Version {
+	return PEP440Version{Epoch: v.Epoch, Release: v.Release, Post: -1, Dev: -1}
+}
+
+// String returns the normalized form of the version
+func (v PEP440Version) String() string {
+	var sb strings.Builder
+	if v.Epoch != 0 {
+		fmt.Fprintf(&sb, "%d!", v.Epoch)
+	}
+	for i, c := range v.Release {
+		if i > 0 {
+			sb.WriteByte('.')
+		}
+		sb.WriteString(strconv.Itoa(c))
+	}
+	if v.PreLabel != "" {
+		fmt.Fprintf(&sb, "%s%d", v.PreLabel, v.PreNumber)
+	}
+	if v.Post != -1 {
+		fmt.Fprintf(&sb, ".post%d", v.Post)
+	}
+	if v.Dev != -1 {
+		fmt.Fprintf(&sb, ".dev%d", v.Dev)
+	}
+	if v.Local != "" {
+		sb.WriteString("+" + v.Local)
+	}
+	return sb.String()
+}
+
+// Compare compares the version with another version in PEP 440 order and returns:
+// -1 if the version is less than the other version
+// 0 if the version is equal to the other version
+// 1 if the version is greater than the other version
+func (v PEP440Version) Compare(other PEP440Version) int {
+	if c := sign(v.Epoch - other.Epoch); c != 0 {
+		return c
+	}
+	// trailing zeros don't count, 1.0 == 1.0.0
+	for i := 0; i < len(v.Release) || i < len(other.Release); i++ {
+		var a, b int
+		if i < len(v.Release) {
+			a = v.Release[i]
+		}
+		if i < len(other.Release) {
+			b = other.Release[i]
+		}
+		if a != b {
+			return sign(a - b)
+		}
+	}
+	if c := compareKeys(v.preKey(), other.preKey()); c != 0 {
+		return c
+	}
+	if c := sign(v.Post - other.Post); c != 0 {
+		return c
+	}
+	if c := compareKeys(v.devKey(), other.devKey()); c != 0 {
+		return c
+	}
+	return compareLocal(v.Local, other.Local)
+}
+
+// preKey orders the pre-release part: 1.0.dev0 < 1.0a1 < 1.0b1 < 1.0rc1 < 1.0
+func (v PEP440Version) preKey() [2]int {
+	switch {
+	case v.PreLabel == "a":
+		return [2]int{1, v.PreNumber}
+	case v.PreLabel == "b":
+		return [2]int{2, v.PreNumber}
+	case v.PreLabel == "rc":
+		return [2]int{3, v.PreNumber}
+	case v.Post == -1 && v.Dev != -1:
+		// a development release of the final release comes before its pre-releases
+		return [2]int{0, 0}
+	}
+	return [2]int{4, 0}
+}
+
+// devKey orders the development release part: 1.0.post1.dev1 < 1.0.post1
+func (v PEP440Version) devKey() [2]int {
+	if v.Dev == -1 {
+		return [2]int{1, 0}
+	}
+	return [2]int{0, v.Dev}
+}
+
+func compareKeys(a [2]int, b [2]int) int {
+	if a[0] != b[0] {
+		return sign(a[0] - b[0])
+	}
+	return sign(a[1] - b[1])
+}
+
+// compareLocal orders local labels segment by segment.  Numeric segments sort after alphanumeric
+// ones, and a version without a label sorts before every version with one.
+func compareLocal(a string, b string) int {
+	if a == "" || b == "" {
+		return sign(len(a) - len(b))
+	}
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		switch {
+		case aerr == nil && berr == nil:
+			if an != bn {
+				return sign(an - bn)
+			}
+		case aerr == nil:
+			return 1
+		case berr == nil:
+			return -1
+		case as[i] != bs[i]:
+			return strings.Compare(as[i], bs[i])
+		}
+	}
+	return sign(len(as) - len(bs))
+}
+
+// Specifier is a single PEP 440 version specifier, e.g. ">=1.2" or "==1.2.*"
+type Specifier struct {
+	Operator string // One of "~=", "==", "!=", "<=", ">=", "<", ">" and "==="
+	Version  string // The version as written, including a trailing ".*" for prefix matches
+}
+
+// specifierRegexp matches a single specifier, capturing the operator and the version
+var specifierRegexp = regexp.MustCompile(`^(~=|===|==|!=|<=|>=|<|>)\s*(\S+)$`)
+
+// ParseSpecifier parses a single PEP 440 version specifier
+func ParseSpecifier(spec string) (Specifier, error) {
+	m := specifierRegexp.FindStringSubmatch(strings.TrimSpace(spec))
+	if m == nil {
+		return Specifier{}, fmt.Errorf("invalid version specifier %q", spec)
+	}
+	s := Specifier{Operator: m[1], Version: m[2]}
+	if s.Operator == "===" {
+		return s, nil
+	}
+	version := s.Version
+	if strings.HasSuffix(version, ".*") {
+		if s.Operator != "==" && s.Operator != "!=" {
+			return Specifier{}, fmt.Errorf("invalid version specifier %q: %s can't be used with a wildcard", spec, s.Operator)
+		}
+		version = strings.TrimSuffix(version, ".*")
+	}
+	v, err := ParsePEP440Version(version)
+	if err != nil {
+		return Specifier{}, fmt.Errorf("invalid version specifier %q: %v", spec, err)
+	}
+	switch {
+	case version != s.Version && (v.PreLabel != "" || v.Post != -1 || v.Dev != -1 || v.Local != ""):
+		return Specifier{}, fmt.Errorf("invalid version specifier %q: a wildcard must follow the release", spec)
+	case s.Operator == "~=" && len(v.Release) < 2:
+		return Specifier{}, fmt.Errorf("invalid version specifier %q: ~= needs at least two release components", spec)
+	case v.Local != "" && s.Operator != "==" && s.Operator != "!=":
+		return Specifier{}, fmt.Errorf("invalid version specifier %q: a local version can only be compared with == or !=", spec)
+	}
+	return s, nil
+}
+
+// String returns the specifier, e.g. ">=1.2"
+func (s Specifier) String() string {
+	return s.Operator + s.Version
+}
+
+// wildcard reports whether the specifier matches a prefix, e.g. "==1.2.*"
+func (s Specifier) wildcard() bool {
+	return strings.HasSuffix(s.Version, ".*")
+}
+
+// version returns the specifier's version without the wildcard
+func (s Specifier) version() PEP440Version {
+	// ParseSpecifier validated the version
+	v, _ := ParsePEP440Version(strings.TrimSuffix(s.Version, ".*"))
+	return v
+}
+
+// Prerelease reports whether the specifier explicitly mentions a pre-release, which allows
+// pre-releases to match
+func (s Specifier) Prerelease() bool {
+	switch s.Operator {
+	case "==", ">=", "<=", "~=", "===":
+		v, err := ParsePEP440Version(strings.TrimSuffix(s.Version, ".*"))
+		return err == nil && v.IsPrerelease()
+	}
+	return false
+}
+
+// Contains reports whether the version satisfies the specifier, regardless of pre-releases.
+// "===" compares the version as it was written, without normalizing it.
+func (s Specifier) Contains(v PEP440Version) bool {
+	if s.Operator == "===" {
+		original := v.original
+		if original == "" {
+			original = v.String()
+		}
+		return strings.EqualFold(original, s.Version)
+	}
+	spec := s.version()
+	switch s.Operator {
+	case "~=":
+		// ~=1.4.5 is >=1.4.5, ==1.4.*
+		prefix := PEP440Version{Epoch: spec.Epoch, Release: spec.Release[:len(spec.Release)-1], Post: -1, Dev: -1}
+		return v.Public().Compare(spec) >= 0 && releaseHasPrefix(v, prefix)
+	case "==", "!=":
+		var equal bool
+		if s.wildcard() {
+			equal = releaseHasPrefix(v, spec)
+		} else if spec.Local == "" {
+			equal = v.Public().Compare(spec) == 0
+		} else {
+			equal = v.Compare(spec) == 0
+		}
+		return equal == (s.Operator == "==")
+	case "<=":
+		return v.Public().Compare(spec) <= 0
+	case ">=":
+		return v.Public().Compare(spec) >= 0
+	case "<":
+		// <3.1 doesn't match 3.1.0rc1 unless it names a pre-release itself
+		if !spec.IsPrerelease() && v.IsPrerelease() && v.BaseVersion().Compare(spec.BaseVersion()) == 0 {
+			return false
+		}
+		return v.Public().Compare(spec) < 0
+	case ">":
+		// >3.1 doesn't match 3.1.post1 or 3.1+local unless it names a post-release itself
+		if v.BaseVersion().Compare(spec.BaseVersion()) == 0 && ((!spec.IsPostrelease() && v.IsPostrelease()) || v.Local != "") {
+			return false
+		}
+		return v.Public().Compare(spec) > 0
+	}
+	return false
+}
+
+// releaseHasPrefix reports whether the version's epoch and release start with those of prefix, with
+// missing release components counting as 0
+func releaseHasPrefix(v PEP440Version, prefix PEP440Version) bool {
+	if v.Epoch != prefix.Epoch {
+		return false
+	}
+	for i, c := range prefix.Release {
+		component := 0
+		if i < len(v.Release) {
+			component = v.Release[i]
+		}
+		if component != c {
+			return false
+		}
+	}
+	return true
+}
+
+// SpecifierSet is a comma separated list of PEP 440 version specifiers, e.g. ">=1.2,!=1.3.*,<2", all of
+// which a version must satisfy
+type SpecifierSet struct {
+	Specifiers []Specifier
+	// Let pre-releases match even though no specifier mentions one
+	Prereleases bool
+}
+
+// ParseSpecifierSet parses a comma separated list of version specifiers.  An empty string is a set
+// every final release satisfies.
+func ParseSpecifierSet(specs string) (*SpecifierSet, error) {
+	set := &SpecifierSet{}
+	if strings.TrimSpace(specs) == "" {
+		return set, nil
+	}
+	for _, part := range strings.Split(specs, ",") {
+		s, err := ParseSpecifier(part)
+		if err != nil {
+			return nil, err
+		}
+		set.Specifiers = append(set.Specifiers, s)
+	}
+	return set, nil
+}
+
+// Contains reports whether the version satisfies every specifier in the set.  As PEP 440 asks,
+// pre-releases only match if Prereleases is set or a specifier mentions a pre-release.
+func (set *SpecifierSet) Contains(v PEP440Version) bool {
+	if v.IsPrerelease() && !set.allowsPrereleases() {
+		return false
+	}
+	for _, s := range set.Specifiers {
+		if !s.Contains(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// allowsPrereleases reports whether pre-releases may match the set
+func (set *SpecifierSet) allowsPrereleases() bool {
+	if set.Prereleases {
+		return true
+	}
+	for _, s := range set.Specifiers {
+		if s.Prerelease() {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the specifiers joined by commas
+func (set *SpecifierSet) String() string {
+	specs := make([]string, len(set.Specifiers))
+	for i, s := range set.Specifiers {
+		specs[i] = s.String()
+	}
+	return strings.Join(specs, ",")
+}
@@ -0,0 +1,267 @@
+package pkg
+
+import "testing"
+
+// The versions below are in increasing order, taken from PEP 440 and the packaging project's test suite
+var pep440Ordered = []string{
+	// implicit epoch of 0
+	"1.0.dev456",
+	"1.0a1",
+	"1.0a2.dev456",
+	"1.0a12.dev456",
+	"1.0a12",
+	"1.0b1.dev456",
+	"1.0b2",
+	"1.0b2.post345.dev456",
+	"1.0b2.post345",
+	"1.0b2-346",
+	"1.0c1.dev456",
+	"1.0c1",
+	"1.0rc2",
+	"1.0c3",
+	"1.0",
+	"1.0.post456.dev34",
+	"1.0.post456",
+	"1.1.dev1",
+	"1.2+123abc",
+	"1.2+123abc456",
+	"1.2+abc",
+	"1.2+abc123",
+	"1.2+abc123def",
+	"1.2+1234.abc",
+	"1.2+123456",
+	"1.2.r32+123456",
+	"1.2.rev33+123456",
+	// explicit epoch of 1
+	"1!1.0.dev456",
+	"1!1.0a1",
+	"1!1.0a2.dev456",
+	"1!1.0a12.dev456",
+	"1!1.0a12",
+	"1!1.0b1.dev456",
+	"1!1.0b2",
+	"1!1.0b2.post345.dev456",
+	"1!1.0b2.post345",
+	"1!1.0b2-346",
+	"1!1.0c1.dev456",
+	"1!1.0c1",
+	"1!1.0rc2",
+	"1!1.0c3",
+	"1!1.0",
+	"1!1.0.post456.dev34",
+	"1!1.0.post456",
+	"1!1.1.dev1",
+	"1!1.2+123abc",
+	"1!1.2+123abc456",
+	"1!1.2+abc",
+	"1!1.2+abc123",
+	"1!1.2+abc123def",
+	"1!1.2+1234.abc",
+	"1!1.2+123456",
+	"1!1.2.r32+123456",
+	"1!1.2.rev33+123456",
+}
+
+func TestPEP440VersionOrder(t *testing.T) {
+	versions := make([]PEP440Version, len(pep440Ordered))
+	for i, s := range pep440Ordered {
+		v, err := ParsePEP440Version(s)
+		if err != nil {
+			t.Fatalf("ParsePEP440Version(%q): %v", s, err)
+		}
+		versions[i] = v
+	}
+	for i := range versions {
+		for j := range versions {
+			want := sign(i - j)
+			if got := versions[i].Compare(versions[j]); got != want {
+				t.Errorf("%s.Compare(%s) = %d, want %d", pep440Ordered[i], pep440Ordered[j], got, want)
+			}
+		}
+	}
+}
+
+func TestPEP440VersionEquality(t *testing.T) {
+	tests := []struct {
+		a, b string
+	}{
+		{"1.0", "1.0.0"},
+		{"1.0", "1.0.0.0"},
+		{"1.0c1", "1.0rc1"},
+		{"1.0-1", "1.0.post1"},
+		{"1!1.0", "1!1.0.0"},
+		{"1.0+UBUNTU-1", "1.0+ubuntu.1"},
+		{"v1.0", "1.0"},
+		{"01.002", "1.2"},
+	}
+	for _, tt := range tests {
+		a, err := ParsePEP440Version(tt.a)
+		if err != nil {
+			t.Fatalf("ParsePEP440Version(%q): %v", tt.a, err)
+		}
+		b, err := ParsePEP440Version(tt.b)
+		if err != nil {
+			t.Fatalf("ParsePEP440Version(%q): %v", tt.b, err)
+		}
+		if a.Compare(b) != 0 || b.Compare(a) != 0 {
+			t.Errorf("%s and %s compare as different versions", tt.a, tt.b)
+		}
+	}
+}
+
+func TestParsePEP440Version(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // normalized form, "" if in is invalid
+	}{
+		{"1.0", "1.0"},
+		{"v1.0", "1.0"},
+		{" 1.0 ", "1.0"},
+		{"01.002", "1.2"},
+		{"1.0a", "1.0a0"},
+		{"1.0.a1", "1.0a1"},
+		{"1.0-alpha1", "1.0a1"},
+		{"1.0_beta_2", "1.0b2"},
+		{"1.0c1", "1.0rc1"},
+		{"1.0pre1", "1.0rc1"},
+		{"1.0preview1", "1.0rc1"},
+		{"1.0RC1", "1.0rc1"},
+		{"1.0-1", "1.0.post1"},
+		{"1.0.post", "1.0.post0"},
+		{"1.0r", "1.0.post0"},
+		{"1.0.rev1", "1.0.post1"},
+		{"1.0-dev", "1.0.dev0"},
+		{"1.0.DEV2", "1.0.dev2"},
+		{"1!2.0.1rc1.post2.dev3+local.1", "1!2.0.1rc1.post2.dev3+local.1"},
+		{"1.0+UBUNTU-1", "1.0+ubuntu.1"},
+		{"1.0+ubuntu_1", "1.0+ubuntu.1"},
+		{"french toast", ""},
+		{"1.0+", ""},
+		{"1.0+_foo", ""},
+		{"1.0+foo..bar", ""},
+		{"1.0.dev1.post1", ""},
+		{"1.0-", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		v, err := ParsePEP440Version(tt.in)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("ParsePEP440Version(%q) = %s, want an error", tt.in, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParsePEP440Version(%q): %v", tt.in, err)
+		} else if got := v.String(); got != tt.want {
+			t.Errorf("ParsePEP440Version(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSpecifierSetContains(t *testing.T) {
+	tests := []struct {
+		version string
+		spec    string
+		want    bool
+	}{
+		{"2.0", "==2", true},
+		{"2.0", "==2.0", true},
+		{"2.0", "==2.0.0", true},
+		{"2.0+deadbeef", "==2", true},
+		{"2.0+deadbeef", "==2.0", true},
+		{"2.0+deadbeef", "==2.0+deadbeef", true},
+		{"2.0+deadbeef", "==2.0.*", true},
+		{"2.0.0", "==2.0.*", true},
+		{"2.0.0", "==2.*", true},
+		{"2.1", "==2", false},
+		{"2.1", "==2.0", false},
+		{"2.0+deadbeef", "==2.0+deadbeef.1", false},
+		{"2.1", "!=2", true},
+		{"2.0", "!=2.1", true},
+		{"2.1+local", "!=2.0", true},
+		{"2.0", "!=2", false},
+		{"2.0", "!=2.0.*", false},
+		{"2.0.0", "!=2.*", false},
+		{"2.0+deadbeef", "!=2.0", false},
+		{"2.0", "<=2", true},
+		{"2.0", "<=2.0", true},
+		{"2.1", "<=2", false},
+		{"2.0", ">=2", true},
+		{"2.0.0", ">=2", true},
+		{"1.0", ">=2", false},
+		{"1.0", "<2", true},
+		{"2.0", "<2", false},
+		{"2.0.1", ">2", true},
+		{"2.0.post1", ">2", false},
+		{"2.0.post1", ">2.0.post0", true},
+		{"2.0+local.version", ">2", false},
+		{"2.1", "~=2.0", true},
+		{"2.0.1", "~=2.0", true},
+		{"2.0.1", "~=2.0.1", true},
+		{"1!1.0", "~=1!1.0", true},
+		{"3.0", "~=2.0", false},
+		{"2.1", "~=2.0.1", false},
+		{"1.0", "~=1!1.0", false},
+		{"2.5", ">=2,<3,!=2.4.*", true},
+		{"2.4.1", ">=2,<3,!=2.4.*", false},
+		// pre-releases only match when a specifier mentions one
+		{"2.0.dev1", ">=2", false},
+		{"2.0rc1", ">=1.9", false},
+		{"2.0rc1", ">=2.0rc1", true},
+		{"3.0.0rc1", "<3.0.0rc2", false},
+		{"2.0rc1", "<2.0", false},
+		// arbitrary equality compares the version as written
+		{"1.0", "===1.0", true},
+		{"1.0RC1", "===1.0rc1", true},
+		{"v1.0", "===v1.0", true},
+		{"1.0.a1", "===1.0.a1", true},
+		{"1.0.0", "===1.0", false},
+		{"1.0", "===1.0.0", false},
+		{"1.0a1", "===1.0.a1", false},
+		{"v1.0", "===1.0", false},
+	}
+	for _, tt := range tests {
+		v, err := ParsePEP440Version(tt.version)
+		if err != nil {
+			t.Fatalf("ParsePEP440Version(%q): %v", tt.version, err)
+		}
+		set, err := ParseSpecifierSet(tt.spec)
+		if err != nil {
+			t.Fatalf("ParseSpecifierSet(%q): %v", tt.spec, err)
+		}
+		if got := set.Contains(v); got != tt.want {
+			t.Errorf("%q contains %s = %v, want %v", tt.spec, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestSpecifierSetPrereleases(t *testing.T) {
+	v, err := ParsePEP440Version("2.0rc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := ParseSpecifierSet(">=1.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set.Prereleases = true
+	if !set.Contains(v) {
+		t.Errorf("%q with Prereleases doesn't contain %s", set.String(), v)
+	}
+}
+
+func TestParseSpecifier(t *testing.T) {
+	valid := []string{"==2.0", "== 2.0", "~=2.0", "!=2.0.*", "===anything-goes", ">=1!2.0", "==1.0+local"}
+	for _, s := range valid {
+		if _, err := ParseSpecifier(s); err != nil {
+			t.Errorf("ParseSpecifier(%q): %v", s, err)
+		}
+	}
+	invalid := []string{"2.0", "=>2.0", "~=2", ">=2.0.*", "==2.0a1.*", ">=1.0+local", "~=1.0+local", "==", "==french toast"}
+	for _, s := range invalid {
+		if _, err := ParseSpecifier(s); err == nil {
+			t.Errorf("ParseSpecifier(%q) succeeded, want an error", s)
+		}
+	}
+}
@@ -1,163 +1,446 @@
 package pkg
 
 import (
-	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
 	"os/exec"
-
-	"github.com/schollz/progressbar/v3"
+	"regexp"
+	"strings"
 )
 
+// PipInstallPackages installs the given packages into the environment with pip.
 func (env *Environment) PipInstallPackages(packages []string, index_url string, extra_index_url string, no_cache bool, feedback CreateEnvironmentOptions) error {
-	args := []string{
-		"install",
-		"--no-warn-script-location",
+	return env.PipInstallPackagesContext(context.Background(), packages, index_url, extra_index_url, no_cache, feedback)
+}
+
+// PipInstallPackagesContext is like PipInstallPackages but kills pip when ctx is done.
+func (env *Environment) PipInstallPackagesContext(ctx context.Context, packages []string, index_url string, extra_index_url string, no_cache bool, feedback CreateEnvironmentOptions) error {
+	opts := &PipInstallOptions{IndexURL: index_url, NoCache: no_cache, Feedback: feedback}
+	if extra_index_url != "" {
+		opts.ExtraIndexURLs = []string{extra_index_url}
 	}
+	return env.PipInstallPackagesWithOptions(ctx, packages, opts)
+}
+
+// PipUpgradeStrategy controls how pip upgrades the dependencies of the packages it installs
+type PipUpgradeStrategy string
+
+const (
+	// Upgrade dependencies only if they don't satisfy the requirements, pip's default
+	PipUpgradeOnlyIfNeeded PipUpgradeStrategy = "only-if-needed"
+	// Upgrade all dependencies to their newest versions
+	PipUpgradeEager PipUpgradeStrategy = "eager"
+)
 
-	if no_cache {
+// PipInstallOptions configures installing packages with pip.  The zero value installs from PyPI,
+// or the index of pip's configuration, and shows a progress bar.
+type PipInstallOptions struct {
+	IndexURL        string             // Base URL of the package index, replacing PyPI
+	ExtraIndexURLs  []string           // Indexes to use in addition to IndexURL
+	FindLinks       []string           // URLs or local directories to look for archives in
+	TrustedHosts    []string           // Hosts, e.g. "pypi.example.com:8080", trusted without valid HTTPS
+	Constraints     []string           // Constraint files limiting the versions installed
+	Editable        []string           // Local projects or VCS URLs installed in editable mode
+	Upgrade         bool               // Upgrade the packages to the newest available versions
+	UpgradeStrategy PipUpgradeStrategy // How dependencies are upgraded, defaults to PipUpgradeOnlyIfNeeded
+	Pre             bool               // Allow pre-releases and development releases
+	NoDeps          bool               // Don't install dependencies
+	ForceReinstall  bool               // Reinstall the packages even if they are up to date
+	NoCache         bool               // Don't use or fill pip's cache
+	OnlyBinary      []string           // Packages to only install from wheels, ":all:" for every package
+	NoBinary        []string           // Packages to never install from wheels, ":all:" for every package
+	// Directory to install into instead of the environment.  Packages installed there are not
+	// recorded in the environment's manifest.
+	Target   string
+	Feedback CreateEnvironmentOptions // User feedback, unless the environment has a Reporter
+}
+
+// args returns the pip install arguments for the options
+func (opts *PipInstallOptions) args() []string {
+	args := []string{"install", "--no-warn-script-location"}
+	if opts.IndexURL != "" {
+		args = append(args, "--index-url", opts.IndexURL)
+	}
+	for _, url := range opts.ExtraIndexURLs {
+		args = append(args, "--extra-index-url", url)
+	}
+	for _, link := range opts.FindLinks {
+		args = append(args, "--find-links", link)
+	}
+	for _, host := range opts.TrustedHosts {
+		args = append(args, "--trusted-host", host)
+	}
+	for _, constraint := range opts.Constraints {
+		args = append(args, "--constraint", constraint)
+	}
+	if opts.Upgrade {
+		args = append(args, "--upgrade")
+	}
+	if opts.UpgradeStrategy != "" {
+		args = append(args, "--upgrade-strategy", string(opts.UpgradeStrategy))
+	}
+	if opts.Pre {
+		args = append(args, "--pre")
+	}
+	if opts.NoDeps {
+		args = append(args, "--no-deps")
+	}
+	if opts.ForceReinstall {
+		args = append(args, "--force-reinstall")
+	}
+	if opts.NoCache {
 		args = append(args, "--no-cache-dir")
 	}
+	if len(opts.OnlyBinary) > 0 {
+		args = append(args, "--only-binary", strings.Join(opts.OnlyBinary, ","))
+	}
+	if len(opts.NoBinary) > 0 {
+		args = append(args, "--no-binary", strings.Join(opts.NoBinary, ","))
+	}
+	if opts.Target != "" {
+		args = append(args, "--target", opts.Target)
+	}
+	for _, project := range opts.Editable {
+		args = append(args, "--editable", project)
+	}
+	return args
+}
 
-	args = append(args, packages...)
-	if index_url != "" {
-		args = append(args, "--index-url", index_url)
+// editableRequirements returns the editable projects as requirements file lines
+func (opts *PipInstallOptions) editableRequirements() []string {
+	var requirements []string
+	for _, project := range opts.Editable {
+		requirements = append(requirements, "-e "+project)
 	}
-	if extra_index_url != "" {
-		args = append(args, "--extra-index-url", extra_index_url)
-	}
-
-	installCmd := exec.Command(env.PipPath, args...)
-	if feedback == ShowVerbose || feedback == ShowNothing {
-		if feedback == ShowVerbose {
-			fmt.Printf("Installing pip packages: %v\n", packages)
-			installCmd.Stdout = os.Stdout
-			installCmd.Stderr = os.Stderr
-		} else {
-			installCmd.Stdout = nil
-			installCmd.Stderr = nil
-		}
-		if err := installCmd.Run(); err != nil {
-			return fmt.Errorf("error installing package: %v", err)
-		}
-	} else {
-		var bar *progressbar.ProgressBar = nil
+	return requirements
+}
 
-		bardesc := "Installing pip packages..."
-		if len(packages) == 1 {
-			bardesc = fmt.Sprintf("Installing pip package %s...", packages[0])
-		}
-		if feedback == ShowProgressBar || feedback == ShowProgressBarVerbose {
-			bar = progressbar.NewOptions(-1,
-				progressbar.OptionEnableColorCodes(true),
-				progressbar.OptionShowBytes(false),
-				progressbar.OptionSetWidth(15),
-				progressbar.OptionSetDescription(bardesc),
-				progressbar.OptionSetTheme(progressbar.Theme{
-					Saucer:        "[green]=[reset]",
-					SaucerHead:    "[green]>[reset]",
-					SaucerPadding: " ",
-					BarStart:      "[",
-					BarEnd:        "]",
-				}))
-		}
+// record adds the requirements installed with the options, and the indexes, find-links and
+// constraints they were installed with, to m
+func (opts *PipInstallOptions) record(m *Manifest, requirements []string) {
+	m.PipPackages = appendUnique(m.PipPackages, requirements...)
+	m.PipPackages = appendUnique(m.PipPackages, opts.editableRequirements()...)
+	if opts.IndexURL != "" {
+		m.PipIndexes = appendUnique(m.PipIndexes, opts.IndexURL)
+	}
+	m.PipIndexes = appendUnique(m.PipIndexes, opts.ExtraIndexURLs...)
+	m.PipFindLinks = appendUnique(m.PipFindLinks, opts.FindLinks...)
+	m.PipConstraints = appendUnique(m.PipConstraints, opts.Constraints...)
+}
 
-		if feedback == ShowProgressBarVerbose {
-			fmt.Printf("Installing pip packages: %v\n", packages)
-		}
+// PipInstallPackagesWithOptions installs the given packages, and opts.Editable, into the environment
+// with pip as configured by opts.  A nil opts is the same as an empty PipInstallOptions.
+func (env *Environment) PipInstallPackagesWithOptions(ctx context.Context, packages []string, opts *PipInstallOptions) error {
+	if opts == nil {
+		opts = &PipInstallOptions{}
+	}
+	bardesc := "Installing pip packages..."
+	if len(packages) == 1 && len(opts.Editable) == 0 {
+		bardesc = fmt.Sprintf("Installing pip package %s...", packages[0])
+	}
+	if err := env.runPip(ctx, env.reporter(opts.Feedback), bardesc, append(opts.args(), packages...)...); err != nil {
+		return fmt.Errorf("error installing package: %w", err)
+	}
+	if opts.Target == "" {
+		env.recordInManifest(func(m *Manifest) {
+			opts.record(m, packages)
+		})
+	}
+	return nil
+}
 
-		stdout, err := installCmd.StdoutPipe()
-		if err != nil {
-			return nil
-		}
-		defer stdout.Close()
+// PipInstallPackagesDryRun resolves installing the given packages, and opts.Editable, with pip as
+// configured by opts without changing the environment, and returns what the install would do.  pip
+// doesn't report what it would remove or download sizes, so Removed is empty and DownloadSize is 0.
+// A nil opts is the same as an empty PipInstallOptions.
+func (env *Environment) PipInstallPackagesDryRun(ctx context.Context, packages []string, opts *PipInstallOptions) (*TransactionPlan, error) {
+	if opts == nil {
+		opts = &PipInstallOptions{}
+	}
+	// pipDryRun adds the install command itself
+	args := opts.args()[1:]
+	report, err := env.pipDryRun(ctx, append(args, packages...)...)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving packages: %w", err)
+	}
+	installed, err := env.pipInstalledVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-		// continue to read the output until there is no more
-		// or an error occurs
-		if err := installCmd.Start(); err != nil {
-			return nil
+	plan := &TransactionPlan{}
+	for _, item := range report.Install {
+		record := PackageRecord{
+			Name:    item.Metadata.Name,
+			Version: item.Metadata.Version,
+			URL:     item.DownloadInfo.URL,
+			SHA256:  item.DownloadInfo.sha256(),
 		}
-
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			if bar != nil {
-				// we'll use lines to update the progress bar to show we are working
-				bar.Add(1)
-			}
-			if feedback == ShowVerbose || feedback == ShowProgressBarVerbose {
-				fmt.Println(scanner.Text())
-			}
+		version, ok := installed[normalizeDistName(record.Name)]
+		if !ok {
+			plan.Added = append(plan.Added, record)
+			continue
 		}
+		plan.addUpdate(PackageRecord{Name: record.Name, Version: version}, record)
+	}
+	return plan, nil
+}
 
-		if bar != nil {
-			bar.Finish()
-			fmt.Println()
-		}
+// PipInstallRequirmements installs the packages listed in a requirements file with pip.
+func (env *Environment) PipInstallRequirmements(requirementsPath string, feedback CreateEnvironmentOptions) error {
+	return env.PipInstallRequirmementsContext(context.Background(), requirementsPath, feedback)
+}
+
+// PipInstallRequirmementsContext is like PipInstallRequirmements but kills pip when ctx is done.
+func (env *Environment) PipInstallRequirmementsContext(ctx context.Context, requirementsPath string, feedback CreateEnvironmentOptions) error {
+	return env.PipInstallRequirementsWithOptions(ctx, requirementsPath, &PipInstallOptions{Feedback: feedback})
+}
+
+// PipInstallRequirementsWithOptions installs the packages listed in a requirements file, and
+// opts.Editable, with pip as configured by opts.  A nil opts is the same as an empty PipInstallOptions.
+func (env *Environment) PipInstallRequirementsWithOptions(ctx context.Context, requirementsPath string, opts *PipInstallOptions) error {
+	if opts == nil {
+		opts = &PipInstallOptions{}
+	}
+	args := append(opts.args(), "-r", requirementsPath)
+	if err := env.runPip(ctx, env.reporter(opts.Feedback), "Installing pip requirements...", args...); err != nil {
+		return fmt.Errorf("error installing requirements: %w", err)
+	}
+	if opts.Target != "" {
+		return nil
 	}
+	// the requirements were installed, a file that can't be read again only goes unrecorded
+	requirements, _ := readRequirements(requirementsPath)
+	env.recordInManifest(func(m *Manifest) {
+		opts.record(m, requirements)
+	})
 	return nil
 }
 
-func (env *Environment) PipInstallRequirmements(requirementsPath string, feedback CreateEnvironmentOptions) error {
-	installCmd := exec.Command(env.PipPath, "install", "--no-warn-script-location", "-r", requirementsPath)
+// PipInstallPackage installs a single package into the environment with pip.
+func (env *Environment) PipInstallPackage(packageToInstall string, index_url string, extra_index_url string, no_cache bool, feedback CreateEnvironmentOptions) error {
+	return env.PipInstallPackageContext(context.Background(), packageToInstall, index_url, extra_index_url, no_cache, feedback)
+}
 
-	if feedback == ShowVerbose || feedback == ShowNothing {
-		installCmd.Stdout = os.Stdout
-		installCmd.Stderr = os.Stderr
-		if err := installCmd.Run(); err != nil {
-			return fmt.Errorf("error installing requirements: %v", err)
-		}
+// PipInstallPackageContext is like PipInstallPackage but kills pip when ctx is done.
+func (env *Environment) PipInstallPackageContext(ctx context.Context, packageToInstall string, index_url string, extra_index_url string, no_cache bool, feedback CreateEnvironmentOptions) error {
+	packages := []string{
+		packageToInstall,
+	}
+	return env.PipInstallPackagesContext(ctx, packages, index_url, extra_index_url, no_cache, feedback)
+}
+
+// PipError is returned when pip fails or is cancelled
+type PipError struct {
+	Command     string // pip's arguments
+	ExitCode    int    // Exit code of pip, -1 if it didn't exit normally
+	Requirement string // The requirement pip failed on, "" if pip's output doesn't name it
+	Stdout      string // The last lines pip wrote to stdout
+	Stderr      string // The last lines pip wrote to stderr
+	Err         error  // The error running pip, the context's error if pip was cancelled
+}
+
+// Error returns a single line naming the command, the exit code and the requirement.  pip's
+// output is only kept in Stdout and Stderr.
+func (e *PipError) Error() string {
+	msg := fmt.Sprintf("pip %s failed: %v", e.Command, e.Err)
+	if e.ExitCode != -1 {
+		msg = fmt.Sprintf("pip %s failed with exit code %d", e.Command, e.ExitCode)
+	}
+	if e.Requirement != "" {
+		msg += " on requirement " + e.Requirement
+	}
+	return msg
+}
+
+func (e *PipError) Unwrap() error {
+	return e.Err
+}
+
+// pipRequirementRegexps match the lines of pip's output naming the requirement it failed on
+var pipRequirementRegexps = []*regexp.Regexp{
+	regexp.MustCompile(`Could not find a version that satisfies the requirement (\S+)`),
+	regexp.MustCompile(`No matching distribution found for (\S+)`),
+	regexp.MustCompile(`Cannot install (\S+?)(?:,| and | because)`),
+	regexp.MustCompile(`Invalid requirement: '([^']+)'`),
+	regexp.MustCompile(`Failed (?:to build|building wheel for) (\S+)`),
+	// the requirements listed after THESE PACKAGES DO NOT MATCH THE HASHES
+	regexp.MustCompile(`^\s+(\S+) from (?:https?|file)://`),
+}
+
+// pipOutput keeps what a PipError reports while pip runs
+type pipOutput struct {
+	stdout      outputTail
+	stderr      outputTail
+	requirement string
+}
+
+func newPipOutput() *pipOutput {
+	return &pipOutput{stdout: outputTail{max: 20}, stderr: outputTail{max: 20}}
+}
+
+func (o *pipOutput) add(line string, isStderr bool) {
+	if isStderr {
+		o.stderr.add(line)
 	} else {
-		var bar *progressbar.ProgressBar = nil
-
-		if feedback == ShowProgressBar || feedback == ShowProgressBarVerbose {
-			bar = progressbar.NewOptions(-1,
-				progressbar.OptionEnableColorCodes(true),
-				progressbar.OptionShowBytes(false),
-				progressbar.OptionSetWidth(15),
-				progressbar.OptionSetDescription("Installing pip requirements..."),
-				progressbar.OptionSetTheme(progressbar.Theme{
-					Saucer:        "[green]=[reset]",
-					SaucerHead:    "[green]>[reset]",
-					SaucerPadding: " ",
-					BarStart:      "[",
-					BarEnd:        "]",
-				}))
+		o.stdout.add(line)
+	}
+	if o.requirement != "" {
+		return
+	}
+	for _, re := range pipRequirementRegexps {
+		if m := re.FindStringSubmatch(line); m != nil {
+			o.requirement = strings.TrimSuffix(m[1], ":")
+			return
 		}
+	}
+}
 
-		stdout, err := installCmd.StdoutPipe()
-		if err != nil {
-			return nil
-		}
-		defer stdout.Close()
+// error returns the PipError for cmd failing with err.  When ctx is done pip was killed for it,
+// and the PipError wraps ctx.Err() instead.
+func (o *pipOutput) error(ctx context.Context, cmd *exec.Cmd, err error) *PipError {
+	exitCode := -1
+	var exitErr *exec.ExitError
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	} else if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+	return &PipError{
+		Command:     strings.Join(cmd.Args[1:], " "),
+		ExitCode:    exitCode,
+		Requirement: o.requirement,
+		Stdout:      o.stdout.String(),
+		Stderr:      o.stderr.String(),
+		Err:         err,
+	}
+}
 
-		// continue to read the output until there is no more
-		// or an error occurs
-		if err := installCmd.Start(); err != nil {
-			return nil
-		}
+// runPip runs pip with the given arguments as a single step, reporting its output to reporter.
+// Failures are returned as a *PipError.
+func (env *Environment) runPip(ctx context.Context, reporter Reporter, description string, args ...string) error {
+	const step = "pip install"
+	lock, err := env.lockEnv(ctx)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
 
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			if bar != nil {
-				// we'll use lines to update the progress bar to show we are working
-				bar.Add(1)
-			}
-			if feedback == ShowVerbose || feedback == ShowProgressBarVerbose {
-				fmt.Println(scanner.Text())
-			}
-		}
+	reporter.Report(Event{Kind: EventStepStarted, Step: step, Message: description})
 
-		if bar != nil {
-			bar.Finish()
-			fmt.Println()
-		}
+	cmd := exec.CommandContext(ctx, env.PipPath, args...)
+	cmd.Env, err = env.commandEnv()
+	if err != nil {
+		return err
 	}
+	output := newPipOutput()
+	err = runStreaming(cmd, func(line string, stderr bool) {
+		output.add(line, stderr)
+		reporter.Report(Event{Kind: EventPipOutput, Step: step, Message: line})
+	})
+	if err != nil {
+		err = output.error(ctx, cmd, err)
+		reporter.Report(Event{Kind: EventError, Step: step, Err: err})
+		return err
+	}
+
+	reporter.Report(Event{Kind: EventStepDone, Step: step})
 	return nil
 }
 
-func (env *Environment) PipInstallPackage(packageToInstall string, index_url string, extra_index_url string, no_cache bool, feedback CreateEnvironmentOptions) error {
-	packages := []string{
-		packageToInstall,
+// pipReport is the part of the output of pip install --report kinda needs
+type pipReport struct {
+	Install []struct {
+		DownloadInfo pipDownloadInfo `json:"download_info"`
+		Metadata     struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"metadata"`
+	} `json:"install"`
+}
+
+// pipDownloadInfo is where pip would get a package from
+type pipDownloadInfo struct {
+	URL         string `json:"url"`
+	ArchiveInfo *struct {
+		Hash   string            `json:"hash"`
+		Hashes map[string]string `json:"hashes"`
+	} `json:"archive_info"`
+}
+
+// sha256 returns the SHA-256 of the archive, or "" if it is unknown or not an archive
+func (info *pipDownloadInfo) sha256() string {
+	if info.ArchiveInfo == nil {
+		return ""
+	}
+	if sha := info.ArchiveInfo.Hashes["sha256"]; sha != "" {
+		return sha
+	}
+	if sha, ok := strings.CutPrefix(info.ArchiveInfo.Hash, "sha256="); ok {
+		return sha
+	}
+	return ""
+}
+
+// pipCommandOutput runs pip with the environment's network settings and returns its standard
+// output.  Failures are returned as a *PipError.
+func (env *Environment) pipCommandOutput(ctx context.Context, args ...string) (string, error) {
+	var stdout strings.Builder
+	cmd := exec.CommandContext(ctx, env.PipPath, args...)
+	var err error
+	cmd.Env, err = env.commandEnv()
+	if err != nil {
+		return "", err
+	}
+	output := newPipOutput()
+	err = runStreaming(cmd, func(line string, isStderr bool) {
+		output.add(line, isStderr)
+		if !isStderr {
+			stdout.WriteString(line)
+			stdout.WriteByte('\n')
+		}
+	})
+	if err != nil {
+		return "", output.error(ctx, cmd, err)
+	}
+	return stdout.String(), nil
+}
+
+// pipDryRun runs pip install --dry-run with args and returns what pip would install
+func (env *Environment) pipDryRun(ctx context.Context, args ...string) (*pipReport, error) {
+	if env.PipVersion.Compare(Version{Major: 22, Minor: 2, Patch: -1}) < 0 {
+		return nil, fmt.Errorf("pip %s does not support --report, 22.2 or later is required", env.PipVersion.String())
+	}
+	args = append([]string{"install", "--dry-run", "--quiet", "--disable-pip-version-check", "--report", "-"}, args...)
+	output, err := env.pipCommandOutput(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	var report pipReport
+	if err := json.Unmarshal([]byte(output), &report); err != nil {
+		return nil, fmt.Errorf("error decoding pip report: %v", err)
+	}
+	return &report, nil
+}
+
+// pipInstalledVersions returns the version of every distribution in the environment by normalized name
+func (env *Environment) pipInstalledVersions(ctx context.Context) (map[string]string, error) {
+	output, err := env.pipCommandOutput(ctx, "list", "--format", "json", "--disable-pip-version-check")
+	if err != nil {
+		return nil, fmt.Errorf("error running pip list: %w", err)
+	}
+	var list []struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal([]byte(output), &list); err != nil {
+		return nil, fmt.Errorf("error decoding pip list: %v", err)
+	}
+	versions := map[string]string{}
+	for _, dist := range list {
+		versions[normalizeDistName(dist.Name)] = dist.Version
 	}
-	return env.PipInstallPackages(packages, index_url, extra_index_url, no_cache, feedback)
+	return versions, nil
 }
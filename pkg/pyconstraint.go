@@ -0,0 +1,119 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ErrPythonNotAvailable is returned when no python build in the channels satisfies the requested constraint
+var ErrPythonNotAvailable = errors.New("no matching python version available")
+
+// PythonConstraint is a requested Python version, e.g. "3.11", ">=3.10,<3.12" or "~=3.11.4".  All of
+// its comma separated clauses must hold.  Clauses are PEP 440 specifiers, except that a bare version
+// such as "3.11" matches every release it is a prefix of, like conda's "python=3.11".
+type PythonConstraint struct {
+	text       string
+	specifiers *SpecifierSet
+}
+
+// ParsePythonConstraint parses a Python version constraint
+func ParsePythonConstraint(constraint string) (*PythonConstraint, error) {
+	c := &PythonConstraint{text: strings.TrimSpace(constraint), specifiers: &SpecifierSet{}}
+	for _, part := range strings.Split(c.text, ",") {
+		part = strings.TrimSpace(part)
+		// conda's "=3.11" is the same as a bare "3.11", which is "==3.11.*"
+		if strings.HasPrefix(part, "=") && !strings.ContainsAny(part[1:2], "=<>!~") {
+			part = strings.TrimSpace(part[1:])
+		}
+		if part != "" && part[0] >= '0' && part[0] <= '9' {
+			part = "==" + strings.TrimSuffix(part, ".*") + ".*"
+		}
+		s, err := ParseSpecifier(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid python version constraint %q: %v", constraint, err)
+		}
+		c.specifiers.Specifiers = append(c.specifiers.Specifiers, s)
+	}
+	return c, nil
+}
+
+// Matches reports whether version satisfies the constraint
+func (c *PythonConstraint) Matches(version Version) bool {
+	return c.specifiers.Contains(version.pep440())
+}
+
+// String returns the constraint as it was given
+func (c *PythonConstraint) String() string {
+	return c.text
+}
+
+// condaSpec returns the constraint as a python match spec, e.g. "python >=3.10,<3.12" or
+// "python 3.11.*,!=3.11.2", so that the solver picks python together with the other packages.
+// It reports false when a clause has no conda equivalent, such as "===" or a version with a
+// pre-release, post-release or local part.
+func (c *PythonConstraint) condaSpec() (string, bool) {
+	var clauses []string
+	for _, s := range c.specifiers.Specifiers {
+		if s.Operator == "===" || (s.wildcard() && s.Operator != "==") {
+			return "", false
+		}
+		v, err := ParsePEP440Version(strings.TrimSuffix(s.Version, ".*"))
+		if err != nil || v.Epoch != 0 || v.PreLabel != "" || v.Post != -1 || v.Dev != -1 || v.Local != "" {
+			return "", false
+		}
+		if s.wildcard() {
+			// conda's "3.11.*" is PEP 440's "==3.11.*"
+			clauses = append(clauses, s.Version)
+		} else {
+			clauses = append(clauses, s.String())
+		}
+	}
+	// the space separates the name from the version, which may start with a digit
+	return "python " + strings.Join(clauses, ","), true
+}
+
+// ResolvePythonVersion returns the newest final python release in the channels of opts that satisfies
+// constraint.  Pre-releases are never selected.  micromamba is downloaded into rootDir/bin if it is
+// not there yet.  A nil opts is the same as an empty CreateOptions.
+func ResolvePythonVersion(ctx context.Context, rootDir string, constraint string, opts *CreateOptions) (Version, error) {
+	if opts == nil {
+		opts = &CreateOptions{}
+	}
+	c, err := ParsePythonConstraint(constraint)
+	if err != nil {
+		return Version{}, err
+	}
+	if err := ensureRootMicromamba(ctx, rootDir, opts); err != nil {
+		return Version{}, err
+	}
+	return resolvePythonVersion(ctx, micromambaExecutable(filepath.Join(rootDir, "bin")), rootDir, c, opts)
+}
+
+// resolvePythonVersion searches the channels of opts for the newest python satisfying c
+func resolvePythonVersion(ctx context.Context, micromambaPath string, rootDir string, c *PythonConstraint, opts *CreateOptions) (Version, error) {
+	records, err := searchPackages(ctx, micromambaPath, rootDir, "python", opts)
+	if err != nil {
+		return Version{}, err
+	}
+	var best PEP440Version
+	found := false
+	for _, record := range records {
+		if record.Name != "python" {
+			continue
+		}
+		version, err := ParsePEP440Version(record.Version)
+		if err != nil || version.IsPrerelease() || !c.specifiers.Contains(version) {
+			continue
+		}
+		if !found || version.Compare(best) > 0 {
+			best, found = version, true
+		}
+	}
+	if !found {
+		return Version{}, fmt.Errorf("%w: python %s", ErrPythonNotAvailable, c.String())
+	}
+	return ParseVersion(best.String())
+}
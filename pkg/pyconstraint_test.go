@@ -0,0 +1,111 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPythonConstraintCondaSpec(t *testing.T) {
+	tests := []struct {
+		constraint string
+		want       string // "" if conda can't express the constraint
+	}{
+		{"3.10", "python 3.10.*"},
+		{"3", "python 3.*"},
+		{"=3.11", "python 3.11.*"},
+		{"3.11.*", "python 3.11.*"},
+		{"==3.11.*", "python 3.11.*"},
+		{"==3.11.4", "python ==3.11.4"},
+		{">=3.10,<3.12", "python >=3.10,<3.12"},
+		{"~=3.11.4", "python ~=3.11.4"},
+		{"3.10,!=3.10.2", "python 3.10.*,!=3.10.2"},
+		{">=3.9, <3.13, !=3.11.*", ""},
+		{"===3.11.7", ""},
+		{">=3.13.0rc1", ""},
+		{"==3.11.4+local", ""},
+	}
+	for _, tt := range tests {
+		c, err := ParsePythonConstraint(tt.constraint)
+		if err != nil {
+			t.Fatalf("ParsePythonConstraint(%q): %v", tt.constraint, err)
+		}
+		got, ok := c.condaSpec()
+		if tt.want == "" {
+			if ok {
+				t.Errorf("condaSpec of %q = %q, want no conda equivalent", tt.constraint, got)
+			}
+		} else if !ok || got != tt.want {
+			t.Errorf("condaSpec of %q = %q, %v, want %q", tt.constraint, got, ok, tt.want)
+		}
+	}
+}
+
+func TestParsePythonConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		{"3.10", "3.10.13", true},
+		{"3.10", "3.10", true},
+		{"3.10", "3.11.0", false},
+		{"3.1", "3.10.0", false},
+		{"3", "3.12.2", true},
+		{"=3.11", "3.11.8", true},
+		{"=3.11", "3.12.0", false},
+		{"3.11.*", "3.11.8", true},
+		{"==3.11.4", "3.11.4", true},
+		{"==3.11.4", "3.11.5", false},
+		{">=3.10,<3.12", "3.11.7", true},
+		{">=3.10,<3.12", "3.12.0", false},
+		{"~=3.11.4", "3.11.9", true},
+		{"~=3.11.4", "3.12.0", false},
+		{"3.10,!=3.10.2", "3.10.3", true},
+		{"3.10,!=3.10.2", "3.10.2", false},
+		// pre-releases only match a constraint naming one
+		{"3.13", "3.13.0rc1", false},
+		{"==3.13.*", "3.13.0rc1", false},
+		{">=3.12", "3.13.0.dev1", false},
+		{">=3.13.0rc1", "3.13.0rc2", true},
+	}
+	for _, tt := range tests {
+		c, err := ParsePythonConstraint(tt.constraint)
+		if err != nil {
+			t.Fatalf("ParsePythonConstraint(%q): %v", tt.constraint, err)
+		}
+		v, err := ParsePEP440Version(tt.version)
+		if err != nil {
+			t.Fatalf("ParsePEP440Version(%q): %v", tt.version, err)
+		}
+		if got := c.specifiers.Contains(v); got != tt.want {
+			t.Errorf("%q matches %s = %v, want %v", tt.constraint, tt.version, got, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{"", "python3", ">=3.10,", "=>3.10"} {
+		if _, err := ParsePythonConstraint(invalid); err == nil {
+			t.Errorf("ParsePythonConstraint(%q) succeeded, want an error", invalid)
+		}
+	}
+}
+
+func TestWithPythonSpec(t *testing.T) {
+	tests := []struct {
+		specs []string
+		want  []string
+	}{
+		{nil, []string{"python 3.10.*"}},
+		{[]string{"numpy"}, []string{"python 3.10.*", "numpy"}},
+		{[]string{"python=3.11", "numpy>=1.26"}, []string{"python 3.10.*", "numpy>=1.26"}},
+		{[]string{"conda-forge::python>=3.9", "six"}, []string{"python 3.10.*", "six"}},
+		{[]string{"python-dateutil"}, []string{"python 3.10.*", "python-dateutil"}},
+		// a python spec naming a build is exact already
+		{[]string{"python=3.11.4=h955ad1f_0", "six"}, []string{"python=3.11.4=h955ad1f_0", "six"}},
+		{[]string{"python 3.11.* *_cpython"}, []string{"python 3.11.* *_cpython"}},
+	}
+	for _, tt := range tests {
+		if got := withPythonSpec(tt.specs, "python 3.10.*"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("withPythonSpec(%q) = %q, want %q", tt.specs, got, tt.want)
+		}
+	}
+}
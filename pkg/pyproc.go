@@ -18,11 +18,12 @@ import (
 
 // PythonProcess represents a running Python process with its I/O pipes
 type PythonProcess struct {
-	Cmd    *exec.Cmd
-	Stdin  io.WriteCloser
-	Stdout io.ReadCloser
-	Stderr io.ReadCloser
-	script io.WriteCloser // For writing the secondary bootstrap script
+	Cmd     *exec.Cmd
+	Stdin   io.WriteCloser
+	Stdout  io.ReadCloser
+	Stderr  io.ReadCloser
+	script  io.WriteCloser // For writing the secondary bootstrap script
+	useLock *useLock       // Marks the environment as in use while the process runs
 }
 
 type Module struct {
@@ -169,8 +170,18 @@ func (env *Environment) NewPythonProcessFromProgram(program *PythonProgram, envi
 		return nil, err
 	}
 
+	// Mark the environment as in use so it can't be removed underneath the process
+	useLock, err := env.acquireUseLock()
+	if errors.Is(err, errLocked) {
+		return nil, fmt.Errorf("environment %s is being removed", env.Name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error locking environment: %v", err)
+	}
+
 	// Start the command
 	if err := cmd.Start(); err != nil {
+		useLock.Unlock()
 		return nil, err
 	}
 
@@ -187,10 +198,11 @@ func (env *Environment) NewPythonProcessFromProgram(program *PythonProgram, envi
 	}()
 
 	pyProcess := &PythonProcess{
-		Cmd:    cmd,
-		Stdin:  stdinPipe,
-		Stdout: stdoutPipe,
-		Stderr: stderrPipe,
+		Cmd:     cmd,
+		Stdin:   stdinPipe,
+		Stdout:  stdoutPipe,
+		Stderr:  stderrPipe,
+		useLock: useLock,
 	}
 
 	// Set up signal handling
@@ -245,8 +257,18 @@ func (env *Environment) NewPythonProcessFromString(script string, environment_va
 		return nil, err
 	}
 
+	// Mark the environment as in use so it can't be removed underneath the process
+	useLock, err := env.acquireUseLock()
+	if errors.Is(err, errLocked) {
+		return nil, fmt.Errorf("environment %s is being removed", env.Name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error locking environment: %v", err)
+	}
+
 	// Start the command
 	if err := cmd.Start(); err != nil {
+		useLock.Unlock()
 		return nil, err
 	}
 
@@ -259,10 +281,11 @@ func (env *Environment) NewPythonProcessFromString(script string, environment_va
 	}()
 
 	pyProcess := &PythonProcess{
-		Cmd:    cmd,
-		Stdin:  stdinPipe,
-		Stdout: stdoutPipe,
-		Stderr: stderrPipe,
+		Cmd:     cmd,
+		Stdin:   stdinPipe,
+		Stdout:  stdoutPipe,
+		Stderr:  stderrPipe,
+		useLock: useLock,
 	}
 
 	// Set up signal handling
@@ -274,6 +297,7 @@ func (env *Environment) NewPythonProcessFromString(script string, environment_va
 // Wait waits for the Python process to exit and returns an error if it was killed
 func (pp *PythonProcess) Wait() error {
 	err := pp.Cmd.Wait()
+	pp.useLock.Unlock()
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			if exitErr.ExitCode() == -1 {
@@ -316,6 +340,7 @@ func (pp *PythonProcess) Terminate() error {
 	case err = <-done:
 		// Process exited before timeout
 	}
+	pp.useLock.Unlock()
 
 	return err
 }
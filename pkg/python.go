@@ -2,17 +2,25 @@ package pkg
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"sync"
 )
 
 // RunReadStdout is a general function to run a binary and return the standard output.
 // This can be used to run any binary, not just Python scripts.
 // RunReadStdout blocks until the child process exits.
 func RunReadStdout(binPath string, args ...string) (string, error) {
+	return RunReadStdoutContext(context.Background(), binPath, args...)
+}
+
+// RunReadStdoutContext is like RunReadStdout but kills the child process when ctx is done.
+func RunReadStdoutContext(ctx context.Context, binPath string, args ...string) (string, error) {
 	retv := ""
-	cmd := exec.Command(binPath, args...)
+	cmd := exec.CommandContext(ctx, binPath, args...)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return "", err
@@ -28,9 +36,52 @@ func RunReadStdout(binPath string, args ...string) (string, error) {
 	for scanner.Scan() {
 		retv += scanner.Text() + "\n"
 	}
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return retv, ctx.Err()
+		}
+		return retv, err
+	}
 	return retv, nil
 }
 
+// runStreaming runs cmd and calls onLine for every line the child process writes
+// to stdout or stderr.  onLine is never called concurrently.
+// runStreaming blocks until the child process exits.
+func runStreaming(cmd *exec.Cmd, onLine func(line string, stderr bool)) error {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	scan := func(r io.Reader, isStderr bool) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 16*1024*1024)
+		for scanner.Scan() {
+			mu.Lock()
+			onLine(scanner.Text(), isStderr)
+			mu.Unlock()
+		}
+	}
+	wg.Add(2)
+	go scan(stdout, false)
+	go scan(stderr, true)
+
+	// all output must be read before waiting
+	wg.Wait()
+	return cmd.Wait()
+}
+
 // RunPythonReadCombined runs a Python script and returns the combined standard output and standard error.
 // RunPythonReadCombined blocks until the child process exits.
 func (env *Environment) RunPythonReadCombined(scriptPath string, args ...string) (string, error) {
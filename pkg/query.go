@@ -0,0 +1,157 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// MicromambaList returns the conda packages installed in the environment
+func (env *Environment) MicromambaList() ([]PackageRecord, error) {
+	return env.MicromambaListContext(context.Background())
+}
+
+// MicromambaListContext is like MicromambaList but kills micromamba when ctx is done.
+func (env *Environment) MicromambaListContext(ctx context.Context) ([]PackageRecord, error) {
+	if env.MicromambaPath == "" {
+		return nil, fmt.Errorf("micromamba is not installed in %s", env.RootDir)
+	}
+	cmd := exec.CommandContext(ctx, env.MicromambaPath, "list", "--no-rc", "--prefix", env.EnvPath, "--json")
+	var err error
+	cmd.Env, err = env.commandEnv()
+	if err != nil {
+		return nil, err
+	}
+	output, err := micromambaQuery(ctx, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("error listing packages: %w", err)
+	}
+	var list []struct {
+		Name        string `json:"name"`
+		Version     string `json:"version"`
+		BuildString string `json:"build_string"`
+		BuildNumber int    `json:"build_number"`
+		Channel     string `json:"channel"`
+		Platform    string `json:"platform"`
+		DistName    string `json:"dist_name"`
+	}
+	if err := json.Unmarshal(output, &list); err != nil {
+		return nil, fmt.Errorf("error decoding micromamba list: %v", err)
+	}
+
+	records := make([]PackageRecord, 0, len(list))
+	for _, p := range list {
+		record := PackageRecord{
+			Name:        p.Name,
+			Version:     p.Version,
+			BuildString: p.BuildString,
+			BuildNumber: p.BuildNumber,
+			Channel:     p.Channel,
+			Subdir:      p.Platform,
+		}
+		// micromamba list leaves out where the package came from, conda-meta has it
+		if data, err := os.ReadFile(filepath.Join(env.EnvPath, "conda-meta", p.DistName+".json")); err == nil {
+			var meta condaRecord
+			if json.Unmarshal(data, &meta) == nil {
+				record.URL, record.Filename, record.MD5, record.SHA256, record.Size = meta.URL, meta.Filename, meta.MD5, meta.SHA256, meta.Size
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// MicromambaSearch returns the packages matching a conda match spec, e.g. "python>=3.11", offered
+// by channels, or by micromamba's default channels if none are given.  micromamba is downloaded into
+// rootDir/bin if it is not there yet.
+func MicromambaSearch(rootDir string, spec string, channels []string) ([]PackageRecord, error) {
+	return MicromambaSearchContext(context.Background(), rootDir, spec, channels)
+}
+
+// MicromambaSearchContext is like MicromambaSearch but aborts the download and kills micromamba when
+// ctx is done.
+func MicromambaSearchContext(ctx context.Context, rootDir string, spec string, channels []string) ([]PackageRecord, error) {
+	opts := &CreateOptions{Channels: channels, Reporter: nopReporter{}}
+	if err := ensureRootMicromamba(ctx, rootDir, opts); err != nil {
+		return nil, err
+	}
+	return searchPackages(ctx, micromambaExecutable(filepath.Join(rootDir, "bin")), rootDir, spec, opts)
+}
+
+// ensureRootMicromamba makes sure rootDir/bin holds the micromamba opts ask for
+func ensureRootMicromamba(ctx context.Context, rootDir string, opts *CreateOptions) error {
+	binDirectory := filepath.Join(rootDir, "bin")
+	if err := os.MkdirAll(binDirectory, 0755); err != nil {
+		return fmt.Errorf("error creating directory: %v", err)
+	}
+	rootLock, err := lockFileWait(ctx, rootLockPath(rootDir), true, opts.LockTimeout)
+	if err != nil {
+		return fmt.Errorf("error locking root directory: %w", err)
+	}
+	defer rootLock.Unlock()
+	_, err = ensureMicromamba(ctx, binDirectory, opts, opts.reporter())
+	return err
+}
+
+// searchPackages searches the channels of opts for spec with micromamba, using the network settings of opts.
+// Like environment creation it reads micromamba's rc files, so both see the same channels.
+func searchPackages(ctx context.Context, micromambaPath string, rootDir string, spec string, opts *CreateOptions) ([]PackageRecord, error) {
+	args := []string{"search", "--root-prefix", rootDir, "--json"}
+	args = append(args, opts.channelArgs()...)
+	cmd := exec.CommandContext(ctx, micromambaPath, append(args, spec)...)
+	vars, err := networkEnv(rootDir, opts.ProxyURL, opts.CABundle)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Env = append(os.Environ(), vars...)
+	cmd.Env = append(cmd.Env, "MAMBA_ROOT_PREFIX="+rootDir)
+	output, err := micromambaQuery(ctx, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("error searching for %s: %w", spec, err)
+	}
+
+	var result struct {
+		Result struct {
+			Msg    string          `json:"msg"`
+			Pkgs   []PackageRecord `json:"pkgs"`
+			Status string          `json:"status"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("error decoding micromamba search: %v", err)
+	}
+	if result.Result.Status != "" && result.Result.Status != "OK" {
+		return nil, fmt.Errorf("error searching for %s: %s", spec, result.Result.Msg)
+	}
+	return result.Result.Pkgs, nil
+}
+
+// micromambaQuery runs a micromamba command given --json that doesn't change anything and returns
+// its output.  Failures are returned as a *MicromambaError.
+func micromambaQuery(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("micromamba cancelled: %v", ctx.Err())
+		}
+		exitCode := -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+		tail := &outputTail{max: 20}
+		for _, line := range strings.Split(stderr.String(), "\n") {
+			tail.add(line)
+		}
+		return nil, &MicromambaError{Command: strings.Join(cmd.Args[1:], " "), ExitCode: exitCode, Stderr: tail.String(), Err: err}
+	}
+	return stdout.Bytes(), nil
+}
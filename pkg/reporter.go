@@ -0,0 +1,181 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// EventKind identifies what an Event reports
+type EventKind int
+
+const (
+	// A step such as creating the environment or a pip install started
+	EventStepStarted EventKind = iota
+	// A step finished successfully
+	EventStepDone
+	// A download started, Total is the expected size in bytes or -1 if unknown
+	EventDownloadStarted
+	// Bytes were received, Bytes is the running total for the download
+	EventDownloadProgress
+	// A download finished
+	EventDownloadFinished
+	// micromamba started solving the environment
+	EventSolveStarted
+	// micromamba linked a package into the environment, Package is its name
+	EventPackageLinked
+	// A line of micromamba output
+	EventMicromambaOutput
+	// A line of pip output
+	EventPipOutput
+	// A step failed, Err holds the error
+	EventError
+)
+
+// Event is a single progress event reported while kinda works on an environment
+type Event struct {
+	Kind    EventKind
+	Step    string // Step the event belongs to, e.g. "create" or "pip install"
+	Message string // Human readable description, or the output line for output events
+	Package string // Package name for EventPackageLinked, file name for EventDownloadStarted
+	Bytes   int64  // Bytes downloaded so far
+	Total   int64  // Total bytes to download, -1 if unknown
+	Err     error  // Error for EventError
+}
+
+// Reporter receives progress events.  Report may be called from any goroutine,
+// but never concurrently for the same step.
+type Reporter interface {
+	Report(event Event)
+}
+
+// ReporterFunc adapts an ordinary function to the Reporter interface
+type ReporterFunc func(event Event)
+
+// Report calls f(event)
+func (f ReporterFunc) Report(event Event) {
+	f(event)
+}
+
+type nopReporter struct{}
+
+func (nopReporter) Report(event Event) {}
+
+type multiReporter []Reporter
+
+func (m multiReporter) Report(event Event) {
+	for _, r := range m {
+		r.Report(event)
+	}
+}
+
+// MultiReporter returns a Reporter that forwards every event to all of the given reporters
+func MultiReporter(reporters ...Reporter) Reporter {
+	return multiReporter(reporters)
+}
+
+// FeedbackReporter returns the built-in Reporter matching a feedback option
+func FeedbackReporter(feedback CreateEnvironmentOptions) Reporter {
+	switch feedback {
+	case ShowProgressBar:
+		return NewProgressBarReporter()
+	case ShowProgressBarVerbose:
+		return MultiReporter(NewVerboseReporter(os.Stdout), NewProgressBarReporter())
+	case ShowVerbose:
+		return NewVerboseReporter(os.Stdout)
+	}
+	return nopReporter{}
+}
+
+// reporter returns the Reporter to use for an operation on the environment.
+// A Reporter set on the environment takes precedence over feedback.
+func (env *Environment) reporter(feedback CreateEnvironmentOptions) Reporter {
+	if env.Reporter != nil {
+		return env.Reporter
+	}
+	return FeedbackReporter(feedback)
+}
+
+type verboseReporter struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// NewVerboseReporter returns a Reporter that prints step descriptions and all
+// micromamba and pip output to w
+func NewVerboseReporter(w io.Writer) Reporter {
+	return &verboseReporter{w: w}
+}
+
+func (r *verboseReporter) Report(event Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch event.Kind {
+	case EventStepStarted, EventDownloadStarted:
+		if event.Message != "" {
+			fmt.Fprintln(r.w, event.Message)
+		}
+	case EventMicromambaOutput, EventPipOutput:
+		fmt.Fprintln(r.w, event.Message)
+	case EventError:
+		fmt.Fprintf(r.w, "Error: %v\n", event.Err)
+	}
+}
+
+type progressBarReporter struct {
+	bar *progressbar.ProgressBar
+	mu  sync.Mutex
+}
+
+// NewProgressBarReporter returns a Reporter that draws a progress bar on stdout.
+// Downloads show a byte counter, other steps show a spinner that advances with
+// each line of output.
+func NewProgressBarReporter() Reporter {
+	return &progressBarReporter{}
+}
+
+func (r *progressBarReporter) Report(event Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch event.Kind {
+	case EventStepStarted:
+		r.finish()
+		r.bar = progressbar.NewOptions(-1,
+			progressbar.OptionEnableColorCodes(true),
+			progressbar.OptionShowBytes(false),
+			progressbar.OptionSetWidth(15),
+			progressbar.OptionSetDescription(event.Message),
+			progressbar.OptionSetTheme(progressbar.Theme{
+				Saucer:        "[green]=[reset]",
+				SaucerHead:    "[green]>[reset]",
+				SaucerPadding: " ",
+				BarStart:      "[",
+				BarEnd:        "]",
+			}))
+	case EventDownloadStarted:
+		r.finish()
+		r.bar = progressbar.DefaultBytes(event.Total, "Downloading "+event.Package)
+	case EventDownloadProgress:
+		if r.bar != nil {
+			r.bar.Set64(event.Bytes)
+		}
+	case EventMicromambaOutput, EventPipOutput:
+		if r.bar != nil {
+			// we'll use lines to update the progress bar to show we are working
+			r.bar.Add(1)
+		}
+	case EventDownloadFinished, EventStepDone, EventError:
+		r.finish()
+	}
+}
+
+func (r *progressBarReporter) finish() {
+	if r.bar != nil {
+		r.bar.Finish()
+		fmt.Println()
+		r.bar = nil
+	}
+}
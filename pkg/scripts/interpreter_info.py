@@ -0,0 +1,29 @@
+# kinda interpreter discovery script
+# prints where this interpreter keeps its packages, headers and library as JSON
+import json, os, platform, sys, sysconfig
+
+paths = sysconfig.get_paths()
+config_vars = sysconfig.get_config_vars()
+gil_disabled = bool(config_vars.get("Py_GIL_DISABLED"))
+
+if os.name == "nt":
+    # Windows builds don't set LIBDIR or LDLIBRARY, the DLL lives in the prefix
+    library = os.path.join(sys.base_prefix, "python%d%d%s.dll" % (sys.version_info[0], sys.version_info[1], "t" if gil_disabled else ""))
+else:
+    libdir = config_vars.get("LIBDIR") or ""
+    ldlibrary = config_vars.get("LDLIBRARY") or ""
+    library = os.path.join(libdir, ldlibrary) if libdir and ldlibrary else ""
+
+print(json.dumps({
+    "version": platform.python_version(),
+    "implementation": sys.implementation.name,
+    "purelib": paths.get("purelib", ""),
+    "platlib": paths.get("platlib", ""),
+    "include": paths.get("include", ""),
+    "libdir": config_vars.get("LIBDIR") or "",
+    "ldlibrary": config_vars.get("LDLIBRARY") or "",
+    "library": library,
+    "ext_suffix": config_vars.get("EXT_SUFFIX") or "",
+    "abiflags": getattr(sys, "abiflags", ""),
+    "gil_disabled": gil_disabled,
+}))
@@ -0,0 +1,272 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// PackageRecord is a conda package as micromamba reports it in a transaction
+type PackageRecord struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	BuildString string `json:"build_string"`
+	BuildNumber int    `json:"build_number"`
+	Channel     string `json:"channel"` // Channel the package comes from, as micromamba names it
+	Subdir      string `json:"subdir"`  // Platform of the package, e.g. "linux-64" or "noarch"
+	URL         string `json:"url"`
+	Filename    string `json:"fn"`
+	MD5         string `json:"md5"`
+	SHA256      string `json:"sha256"`
+	Size        int64  `json:"size"` // Size of the artifact in bytes
+}
+
+// String returns the record as an exact conda spec, name=version=build
+func (p *PackageRecord) String() string {
+	return p.Name + "=" + p.Version + "=" + p.BuildString
+}
+
+// Transaction is what micromamba did, or would do for a dry run, to an environment
+type Transaction struct {
+	Prefix  string          // Path of the environment
+	DryRun  bool            // Nothing was changed
+	Success bool            // micromamba reported success
+	Link    []PackageRecord // Packages linked into the environment
+	Unlink  []PackageRecord // Packages removed from the environment
+	Fetch   []PackageRecord // Packages downloaded into the package cache
+}
+
+// transactionJSON is the output of micromamba --json for create, install, update and remove
+type transactionJSON struct {
+	Actions struct {
+		Fetch  []PackageRecord `json:"FETCH"`
+		Link   []PackageRecord `json:"LINK"`
+		Unlink []PackageRecord `json:"UNLINK"`
+		Prefix string          `json:"PREFIX"`
+	} `json:"actions"`
+	DryRun         bool     `json:"dry_run"`
+	Prefix         string   `json:"prefix"`
+	Success        bool     `json:"success"`
+	SolverProblems []string `json:"solver_problems"`
+}
+
+// SolverError is returned when micromamba cannot find packages satisfying the requested specs
+type SolverError struct {
+	Problems    []string // The solver's conflict messages
+	Explanation string   // What micromamba wrote to stderr about the conflict
+}
+
+func (e *SolverError) Error() string {
+	if len(e.Problems) == 0 {
+		return "could not solve for environment specs"
+	}
+	return "could not solve for environment specs: " + strings.Join(e.Problems, "; ")
+}
+
+// MicromambaError is returned when micromamba fails for a reason other than an unsolvable request
+type MicromambaError struct {
+	Command  string // micromamba's arguments
+	ExitCode int    // Exit code of micromamba, -1 if it didn't exit normally
+	Stderr   string // The last lines micromamba wrote to stderr
+	Err      error  // The error running micromamba
+}
+
+func (e *MicromambaError) Error() string {
+	msg := fmt.Sprintf("micromamba %s failed: %v", e.Command, e.Err)
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+func (e *MicromambaError) Unwrap() error {
+	return e.Err
+}
+
+// outputTail keeps the last lines of a command's output
+type outputTail struct {
+	lines []string
+	max   int
+}
+
+func (t *outputTail) add(line string) {
+	t.lines = append(t.lines, line)
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+}
+
+func (t *outputTail) String() string {
+	return strings.TrimSpace(strings.Join(t.lines, "\n"))
+}
+
+// runMicromamba runs a micromamba command that was given --json as a step of reporter and decodes
+// the transaction it prints.  micromamba's stderr is reported as output events.  Unsolvable specs
+// are returned as a *SolverError, other failures as a *MicromambaError.
+func runMicromamba(cmd *exec.Cmd, reporter Reporter, step string) (*Transaction, error) {
+	var stdout bytes.Buffer
+	stderr := &outputTail{max: 20}
+	err := runStreaming(cmd, func(line string, isStderr bool) {
+		if isStderr {
+			stderr.add(line)
+			reporter.Report(Event{Kind: EventMicromambaOutput, Step: step, Message: line})
+		} else {
+			stdout.WriteString(line)
+			stdout.WriteByte('\n')
+		}
+	})
+
+	var result transactionJSON
+	var decodeErr error
+	output := stdout.Bytes()
+	if i := bytes.IndexByte(output, '{'); i >= 0 {
+		decodeErr = json.Unmarshal(output[i:], &result)
+	} else {
+		result.Success = err == nil
+	}
+
+	if err != nil {
+		if len(result.SolverProblems) > 0 {
+			return nil, &SolverError{Problems: result.SolverProblems, Explanation: stderr.String()}
+		}
+		exitCode := -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+		return nil, &MicromambaError{Command: strings.Join(cmd.Args[1:], " "), ExitCode: exitCode, Stderr: stderr.String(), Err: err}
+	}
+	if decodeErr != nil {
+		return nil, fmt.Errorf("error decoding micromamba output: %v", decodeErr)
+	}
+
+	t := &Transaction{
+		Prefix:  result.Prefix,
+		DryRun:  result.DryRun,
+		Success: result.Success,
+		Link:    result.Actions.Link,
+		Unlink:  result.Actions.Unlink,
+		Fetch:   result.Actions.Fetch,
+	}
+	if t.Prefix == "" {
+		t.Prefix = result.Actions.Prefix
+	}
+	for _, p := range t.Link {
+		reporter.Report(Event{Kind: EventPackageLinked, Step: step, Package: p.Name})
+	}
+	return t, nil
+}
+
+// PackageUpdate is a package replaced by another version of itself
+type PackageUpdate struct {
+	From PackageRecord // The installed package
+	To   PackageRecord // The package replacing it
+}
+
+// TransactionPlan summarizes what a transaction changes in an environment
+type TransactionPlan struct {
+	Added        []PackageRecord // Packages not installed before
+	Removed      []PackageRecord // Packages removed without replacement
+	Upgraded     []PackageUpdate // Packages replaced by a newer version or build
+	Downgraded   []PackageUpdate // Packages replaced by an older version or build
+	DownloadSize int64           // Bytes to download, 0 if unknown
+}
+
+// Plan summarizes the transaction by package
+func (t *Transaction) Plan() *TransactionPlan {
+	plan := &TransactionPlan{}
+	unlinked := map[string]PackageRecord{}
+	for _, p := range t.Unlink {
+		unlinked[p.Name] = p
+	}
+	for _, p := range t.Link {
+		old, ok := unlinked[p.Name]
+		if !ok {
+			plan.Added = append(plan.Added, p)
+			continue
+		}
+		delete(unlinked, p.Name)
+		plan.addUpdate(old, p)
+	}
+	for _, p := range t.Unlink {
+		if _, ok := unlinked[p.Name]; ok {
+			plan.Removed = append(plan.Removed, p)
+		}
+	}
+	for _, p := range t.Fetch {
+		plan.DownloadSize += p.Size
+	}
+	return plan
+}
+
+// addUpdate records the replacement of from by to as an upgrade or downgrade
+func (plan *TransactionPlan) addUpdate(from PackageRecord, to PackageRecord) {
+	c := compareVersions(to.Version, from.Version)
+	if c == 0 {
+		c = to.BuildNumber - from.BuildNumber
+	}
+	if c < 0 {
+		plan.Downgraded = append(plan.Downgraded, PackageUpdate{From: from, To: to})
+	} else {
+		plan.Upgraded = append(plan.Upgraded, PackageUpdate{From: from, To: to})
+	}
+}
+
+// compareVersions compares package versions in PEP 440 order, falling back to compareLooseVersions
+// for conda versions PEP 440 doesn't allow, e.g. "1.1.1w"
+func compareVersions(a string, b string) int {
+	av, aerr := ParsePEP440Version(a)
+	bv, berr := ParsePEP440Version(b)
+	if aerr == nil && berr == nil {
+		return av.Compare(bv)
+	}
+	return compareLooseVersions(a, b)
+}
+
+// compareLooseVersions compares dotted version strings component by component, numerically where
+// both components are numbers and as strings otherwise.  It returns -1, 0 or 1 like Version.Compare.
+func compareLooseVersions(a string, b string) int {
+	as := strings.FieldsFunc(a, isVersionSeparator)
+	bs := strings.FieldsFunc(b, isVersionSeparator)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y string
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		xn, xerr := strconv.Atoi(x)
+		yn, yerr := strconv.Atoi(y)
+		switch {
+		case xerr == nil && yerr == nil:
+			if xn != yn {
+				return sign(xn - yn)
+			}
+		case x == "" || y == "":
+			// 1.0 < 1.0.1
+			return sign(len(x) - len(y))
+		case x != y:
+			return strings.Compare(x, y)
+		}
+	}
+	return 0
+}
+
+func isVersionSeparator(r rune) bool {
+	return r == '.' || r == '-' || r == '_' || r == '+'
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
@@ -12,11 +12,26 @@ type Version struct {
 }
 
 // ParseVersion parses a version string in the format "X.Y.Z" and returns a Version object.
+// PEP 440 versions such as "3.13.0rc1" or "2.1.0.post1" are reduced to their first three
+// release components, use ParsePEP440Version to keep the rest.
 func ParseVersion(versionStr string) (Version, error) {
 	version := Version{
 		Minor: -1,
 		Patch: -1,
 	}
+	if pv, err := ParsePEP440Version(versionStr); err == nil {
+		for i, c := range pv.Release {
+			switch i {
+			case 0:
+				version.Major = c
+			case 1:
+				version.Minor = c
+			case 2:
+				version.Patch = c
+			}
+		}
+		return version, nil
+	}
 	_, err := fmt.Sscanf(versionStr, "%d.%d.%d", &version.Major, &version.Minor, &version.Patch)
 	if err != nil {
 		// If the version string is not in the format "X.Y.Z", try parsing it as "X.Y"
@@ -102,3 +117,15 @@ func (v *Version) MinorString() string {
 func (v *Version) MinorStringCompact() string {
 	return fmt.Sprintf("%d%d", v.Major, v.Minor)
 }
+
+// pep440 returns the version as a PEP 440 release
+func (v *Version) pep440() PEP440Version {
+	pv := PEP440Version{Release: []int{v.Major}, Post: -1, Dev: -1}
+	for _, c := range []int{v.Minor, v.Patch} {
+		if c == -1 {
+			break
+		}
+		pv.Release = append(pv.Release, c)
+	}
+	return pv
+}